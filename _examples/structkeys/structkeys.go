@@ -30,7 +30,14 @@ func (mk *MyKey) UnmarshalBinary(data []byte) error {
 	return err
 }
 
-func (*MyKey) Less(a []byte, b []byte) bool {
+// MyKeyComparator orders the keys of a table by Symbol and then At
+type MyKeyComparator struct{}
+
+func (MyKeyComparator) Name() string {
+	return "structkeys.MyKeyComparator"
+}
+
+func (MyKeyComparator) Compare(a []byte, b []byte) int {
 	_a := MyKey{}
 	_b := MyKey{}
 
@@ -38,10 +45,17 @@ func (*MyKey) Less(a []byte, b []byte) bool {
 	_b.UnmarshalBinary(b)
 
 	c := strings.Compare(_a.Symbol, _b.Symbol)
-	if c == 0 {
-		return _a.At.Before(_b.At)
+	if c != 0 {
+		return c
+	}
+	if _a.At.Before(_b.At) {
+		return -1
+	}
+	if _a.At.After(_b.At) {
+		return 1
 	}
-	return c < 0
+	// keys that decode the same are only equal if they are identical
+	return bytes.Compare(a, b)
 }
 
 func main() {
@@ -49,7 +63,8 @@ func main() {
 	path := "test/structkeys"
 
 	keydb.Remove(path)
-	db, err := keydb.Open(path, true)
+	options := keydb.Options{CreateIfNeeded: true, Tables: map[string]keydb.TableOptions{"main": {Comparator: MyKeyComparator{}}}}
+	db, err := keydb.OpenWithOptions(path, options)
 	if err != nil {
 		panic(err)
 	}
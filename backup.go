@@ -0,0 +1,299 @@
+package keydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// a backup is a directory with the segment files that were written since the previous backup in its chain, and a
+// BACKUP file which records the live segments of every table when the backup was taken, and which backup in the chain
+// holds the files of each. the first backup of a chain is a full backup with every segment file.
+//
+// segment files are immutable, so a segment in the previous backup is not copied again. a merged segment replaces a
+// contiguous range of segment ids of its table, so if every id in the range was already written when the previous
+// backup was taken, the segments of the previous backup in the range hold the same records and are used instead.
+//
+// the BACKUP file is a length/crc framed record (see wal.go) of
+//
+// version uint8 (backupVersion)
+// id uint64 (the time the backup was taken in unix nanoseconds)
+// parent uint64 (the id of the previous backup, 0 for a full backup)
+// seq uint32 (the position of the backup in the chain, 0 for a full backup)
+// maxid uint64 (the highest segment id allocated when the backup was taken)
+// count uint32
+// and count of
+// keyfilelen uint16
+// keyfile []byte
+// seq uint32 (the backup that holds the segment files)
+//
+// followed by a record of a manifest edit (see manifest.go) that creates the tables and their segments
+const backupFilename = "BACKUP"
+
+const backupVersion uint8 = 1
+
+type backupInfo struct {
+	id       uint64
+	parent   uint64
+	seq      uint32
+	maxID    uint64
+	location map[string]uint32 // the backup holding the files of each segment, by key file name
+	manifest *manifest         // the comparators and live segments of the tables
+}
+
+func newBackupInfo() *backupInfo {
+	return &backupInfo{location: make(map[string]uint32), manifest: &manifest{tables: make(map[string][]segmentInfo), comparators: make(map[string]string)}}
+}
+
+// Backup writes a backup of the database to dir, which must not exist. if previous is not "" it is the directory of
+// the last backup of a chain of backups of the database, and the backup only contains the segment files that are not
+// in the chain. like Checkpoint it waits for the open write transactions to complete and the committed segments to be
+// written, delaying new write transactions until then, and pauses the merger while the files are copied
+func (db *Database) Backup(dir string, previous string) error {
+	var prev *backupInfo
+	if previous != "" {
+		var err error
+		if prev, err = readBackup(previous); err != nil {
+			return err
+		}
+	}
+
+	// the merge locks keep the segment files, so the database can be used while they are copied
+	tables, maxID, err := db.quiesceTables()
+	if err != nil {
+		return err
+	}
+	defer releaseTables(tables)
+
+	if prev != nil && prev.maxID > maxID {
+		// the previous backup is of another database
+		return InvalidBackup
+	}
+
+	// an id allocated before the backup must not be reused by a segment that is not in it, even if the segment with
+	// the id is dropped before it is written
+	if err := db.manifest.apply([]manifestChange{{op: setMaxSegmentID, info: segmentInfo{id: maxID}}}, true); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	b := newBackupInfo()
+	b.id = uint64(time.Now().UnixNano())
+	b.maxID = maxID
+	b.manifest.maxID = maxID
+	if prev != nil {
+		b.parent, b.seq = prev.id, prev.seq+1
+		if b.id <= prev.id {
+			b.id = prev.id + 1
+		}
+	}
+
+	err = func() error {
+		for _, t := range tables {
+			b.manifest.comparators[t.name] = db.manifest.comparator(t.name)
+			for _, info := range t.segments {
+				if prev != nil {
+					if replaced := prev.replaced(t.name, info); replaced != nil {
+						for _, r := range replaced {
+							b.manifest.tables[t.name] = append(b.manifest.tables[t.name], r)
+							b.location[r.keyFile] = prev.location[r.keyFile]
+						}
+						continue
+					}
+				}
+				err0 := copyFile(filepath.Join(db.path, info.keyFile), filepath.Join(dir, info.keyFile))
+				err1 := copyFile(filepath.Join(db.path, info.dataFile), filepath.Join(dir, info.dataFile))
+				// the bloom filter is optional
+				err2 := copyFile(filepath.Join(db.path, bloomFilename(info.keyFile)), filepath.Join(dir, bloomFilename(info.keyFile)))
+				if os.IsNotExist(err2) {
+					err2 = nil
+				}
+				if err := errn(err0, err1, err2); err != nil {
+					return err
+				}
+				b.manifest.tables[t.name] = append(b.manifest.tables[t.name], info)
+				b.location[info.keyFile] = b.seq
+			}
+		}
+		return writeBackup(dir, b)
+	}()
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+// returns the segments of the backup that hold the records of a live segment of the table, or nil if the files of
+// the segment must be copied. these are the segment itself, or the segments replaced by a merge since the backup
+func (b *backupInfo) replaced(table string, info segmentInfo) []segmentInfo {
+	if _, ok := b.location[info.keyFile]; ok {
+		return []segmentInfo{info}
+	}
+	// a segment id after the backup may be a segment that is not in the backup
+	if info.id > b.maxID {
+		return nil
+	}
+	var replaced []segmentInfo
+	for _, r := range b.manifest.tables[table] {
+		if r.low >= info.low && r.id <= info.id {
+			replaced = append(replaced, r)
+		}
+	}
+	// a merge replaces whole segments, so the segments of the backup must cover the same range of ids
+	if len(replaced) == 0 || replaced[0].low != info.low || replaced[len(replaced)-1].id != info.id {
+		return nil
+	}
+	return replaced
+}
+
+// Restore creates a database at path, which must not exist, from a chain of backups in the order they were taken,
+// starting with the full backup. the database has the records of the tables when the last backup was taken, and
+// does not reuse the segment ids of the chain, so it can be backed up incrementally from the last backup
+func Restore(path string, backups ...string) error {
+	var chain []*backupInfo
+	for i, dir := range backups {
+		b, err := readBackup(dir)
+		if err != nil {
+			return err
+		}
+		if b.seq != uint32(i) || (i == 0 && b.parent != 0) || (i > 0 && b.parent != chain[i-1].id) {
+			return BrokenBackupChain
+		}
+		chain = append(chain, b)
+	}
+	if len(chain) == 0 {
+		return BrokenBackupChain
+	}
+	last := chain[len(chain)-1]
+
+	path = filepath.Clean(path)
+	if err := os.Mkdir(path, os.ModePerm); err != nil {
+		return err
+	}
+
+	err := func() error {
+		for _, segments := range last.manifest.tables {
+			for _, info := range segments {
+				dir := backups[last.location[info.keyFile]]
+				err0 := copyFile(filepath.Join(dir, info.keyFile), filepath.Join(path, info.keyFile))
+				err1 := copyFile(filepath.Join(dir, info.dataFile), filepath.Join(path, info.dataFile))
+				err2 := copyFile(filepath.Join(dir, bloomFilename(info.keyFile)), filepath.Join(path, bloomFilename(info.keyFile)))
+				if os.IsNotExist(err2) {
+					err2 = nil
+				}
+				if err := errn(err0, err1, err2); err != nil {
+					return err
+				}
+			}
+		}
+		m := last.manifest
+		m.path = path
+		if err := m.rewrite(); err != nil {
+			return err
+		}
+		return m.close()
+	}()
+	if err != nil {
+		os.RemoveAll(path)
+	}
+	return err
+}
+
+func writeBackup(dir string, b *backupInfo) error {
+	header := make([]byte, 1+8+8+4+8+4)
+	header[0] = backupVersion
+	binary.LittleEndian.PutUint64(header[1:], b.id)
+	binary.LittleEndian.PutUint64(header[9:], b.parent)
+	binary.LittleEndian.PutUint32(header[17:], b.seq)
+	binary.LittleEndian.PutUint64(header[21:], b.maxID)
+	binary.LittleEndian.PutUint32(header[29:], uint32(len(b.location)))
+
+	files := make([]string, 0, len(b.location))
+	for keyFile := range b.location {
+		files = append(files, keyFile)
+	}
+	sort.Strings(files)
+
+	var buf [4]byte
+	for _, keyFile := range files {
+		binary.LittleEndian.PutUint16(buf[:], uint16(len(keyFile)))
+		header = append(header, buf[:2]...)
+		header = append(header, keyFile...)
+		binary.LittleEndian.PutUint32(buf[:], b.location[keyFile])
+		header = append(header, buf[:]...)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, backupFilename), os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err0 := f.Write(encodeLogRecord(header))
+	_, err1 := f.Write(encodeLogRecord(encodeManifestEdit(b.manifest.edit())))
+	err2 := f.Sync()
+	err3 := f.Close()
+	if err := errn(err0, err1, err2, err3); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func readBackup(dir string) (*backupInfo, error) {
+	f, err := os.Open(filepath.Join(dir, backupFilename))
+	if os.IsNotExist(err) {
+		return nil, InvalidBackup
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err0 := readLogRecord(r)
+	edit, err1 := readLogRecord(r)
+	if errn(err0, err1) != nil || len(header) < 33 || header[0] != backupVersion {
+		return nil, InvalidBackup
+	}
+
+	b := newBackupInfo()
+	b.id = binary.LittleEndian.Uint64(header[1:])
+	b.parent = binary.LittleEndian.Uint64(header[9:])
+	b.seq = binary.LittleEndian.Uint32(header[17:])
+	b.maxID = binary.LittleEndian.Uint64(header[21:])
+	count := binary.LittleEndian.Uint32(header[29:])
+	header = header[33:]
+	for i := uint32(0); i < count; i++ {
+		if len(header) < 2 {
+			return nil, InvalidBackup
+		}
+		n := int(binary.LittleEndian.Uint16(header))
+		if len(header) < 2+n+4 {
+			return nil, InvalidBackup
+		}
+		seq := binary.LittleEndian.Uint32(header[2+n:])
+		if seq > b.seq {
+			return nil, InvalidBackup
+		}
+		b.location[string(header[2:2+n])] = seq
+		header = header[2+n+4:]
+	}
+
+	changes, err := decodeManifestEdit(edit)
+	if err != nil {
+		return nil, InvalidBackup
+	}
+	b.manifest.applyChanges(changes)
+	for _, segments := range b.manifest.tables {
+		for _, info := range segments {
+			if _, ok := b.location[info.keyFile]; !ok {
+				return nil, InvalidBackup
+			}
+		}
+	}
+	return b, nil
+}
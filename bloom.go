@@ -0,0 +1,184 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// every disk segment written with a bloom filter has a filter file named like its key file, with .bloom. in place of
+// .keys., which allows Get to skip the segments that do not contain a key. the filter holds every key in the segment,
+// including removed keys, since a removed key hides the older values of the key. the format is
+//
+// k uint8 (the number of hash functions)
+// bits []byte
+// crc uint32 (the CRC32C of the preceding bytes)
+//
+// a filter that is missing or corrupt is ignored, and the segment is searched as if the key may be present
+const defaultBloomBitsPerKey = 10
+
+const maxBloomHashes = 30
+
+type bloomFilter struct {
+	k    uint8
+	bits []byte
+}
+
+// FilterStats are the counts of the bloom filter checks made by Get since the database was opened
+type FilterStats struct {
+	// Checks is the number of times a segment filter was consulted
+	Checks uint64
+	// Skipped is the number of checks where the key was not in the filter, so the segment was not searched
+	Skipped uint64
+	// FalsePositives is the number of checks where the key was in the filter, but not in the segment
+	FalsePositives uint64
+}
+
+// the filter statistics of a database, accessed atomically
+type filterStats struct {
+	checks         uint64
+	skipped        uint64
+	falsePositives uint64
+}
+
+// builds a filter for the keys with the given hashes
+func newBloomFilter(hashes []uint64, bitsPerKey int) *bloomFilter {
+	// 0.69 ~= ln(2), which minimizes the false positive rate
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	}
+	if k > maxBloomHashes {
+		k = maxBloomHashes
+	}
+
+	nbits := len(hashes) * bitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+	bf := &bloomFilter{k: uint8(k), bits: make([]byte, (nbits+7)/8)}
+	for _, h := range hashes {
+		bf.add(h)
+	}
+	return bf
+}
+
+// the FNV-1a hash of the key, the filter derives its k hash functions from the two halves
+func bloomHash(key []byte) uint64 {
+	var h uint64 = 14695981039346656037
+	for _, b := range key {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return h
+}
+
+func (bf *bloomFilter) add(hash uint64) {
+	nbits := uint32(len(bf.bits) * 8)
+	h, delta := uint32(hash), uint32(hash>>32)|1
+	for i := uint8(0); i < bf.k; i++ {
+		bit := h % nbits
+		bf.bits[bit/8] |= 1 << (bit % 8)
+		h += delta
+	}
+}
+
+// returns false if the key is definitely not in the filter
+func (bf *bloomFilter) mayContain(key []byte) bool {
+	hash := bloomHash(key)
+	nbits := uint32(len(bf.bits) * 8)
+	h, delta := uint32(hash), uint32(hash>>32)|1
+	for i := uint8(0); i < bf.k; i++ {
+		bit := h % nbits
+		if bf.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h += delta
+	}
+	return true
+}
+
+func bloomFilename(keyFilename string) string {
+	filename := replaceLast(keyFilename, ".keys.", ".bloom.")
+	if filename == keyFilename {
+		filename += ".bloom"
+	}
+	return filename
+}
+
+// writes the filter to the file, syncing it if sync is true
+func writeBloomFilter(filename string, bf *bloomFilter, sync bool) error {
+	buffer := make([]byte, 1+len(bf.bits)+checksumLen)
+	buffer[0] = bf.k
+	copy(buffer[1:], bf.bits)
+	binary.LittleEndian.PutUint32(buffer[1+len(bf.bits):], crc32.Checksum(buffer[:1+len(bf.bits)], crcTable))
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err0 := f.Write(buffer)
+	var err1 error
+	if sync {
+		err1 = f.Sync()
+	}
+	err2 := f.Close()
+	return errn(err0, err1, err2)
+}
+
+// reads the filter from the file, returning nil if it does not exist or is corrupt
+func readBloomFilter(filename string) *bloomFilter {
+	buffer, err := ioutil.ReadFile(filename)
+	if err != nil || len(buffer) < 1+checksumLen+1 {
+		return nil
+	}
+	n := len(buffer) - checksumLen
+	if crc32.Checksum(buffer[:n], crcTable) != binary.LittleEndian.Uint32(buffer[n:]) {
+		return nil
+	}
+	if buffer[0] < 1 || buffer[0] > maxBloomHashes {
+		return nil
+	}
+	return &bloomFilter{k: buffer[0], bits: buffer[1:n]}
+}
+
+// removes the filter of a segment, which may not have one
+func removeBloomFilter(keyFilename string) error {
+	err := os.Remove(bloomFilename(keyFilename))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func isBloomFile(name string) bool {
+	return strings.Contains(name, ".bloom.")
+}
+
+func (s *filterStats) check(skipped bool) {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.checks, 1)
+	if skipped {
+		atomic.AddUint64(&s.skipped, 1)
+	}
+}
+
+func (s *filterStats) falsePositive() {
+	if s == nil {
+		return
+	}
+	atomic.AddUint64(&s.falsePositives, 1)
+}
+
+// FilterStats returns the bloom filter statistics of the database
+func (db *Database) FilterStats() FilterStats {
+	return FilterStats{
+		Checks:         atomic.LoadUint64(&db.filterStats.checks),
+		Skipped:        atomic.LoadUint64(&db.filterStats.skipped),
+		FalsePositives: atomic.LoadUint64(&db.filterStats.falsePositives)}
+}
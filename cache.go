@@ -0,0 +1,226 @@
+package keydb
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+// blockCache is a database wide LRU cache of decoded key blocks, bounded by the approximate memory used by the
+// blocks. blocks are cached by the cache id of their disk segment rather than the segment id, since a merged segment
+// has the same id as the newest segment it replaces. a nil *blockCache caches nothing
+type blockCache struct {
+	sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // most recently used at the front
+	segments map[uint64]map[int64]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	segment uint64
+	block   int64
+	kb      *keyBlock
+}
+
+// keyBlock is a decoded key block, the keys are in order and are not modified once decoded
+type keyBlock struct {
+	keys    [][]byte
+	offsets []int64
+	lengths []uint32
+	flags   []uint8 // nil if the segment version has no entry flags
+	expires []int64 // nil if no value in the block expires
+	size    int64   // the approximate memory used by the block
+}
+
+// CacheStats are the counts of the block cache lookups since the database was opened
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// Size is the approximate memory in bytes used by the cached blocks
+	Size int64
+}
+
+// the default BlockCacheSize
+const defaultBlockCacheSize = 8 * 1024 * 1024
+
+// the approximate memory used by each key of a decoded block, in addition to the key
+const keyBlockEntrySize = 24 + 8 + 4 + 1
+
+// returns a cache of at most capacity bytes, or nil if capacity is not positive
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &blockCache{capacity: capacity, lru: list.New(), segments: make(map[uint64]map[int64]*list.Element)}
+}
+
+var nextCacheID uint64
+
+// returns a unique id for an opened disk segment
+func newCacheID() uint64 {
+	return atomic.AddUint64(&nextCacheID, 1)
+}
+
+func (c *blockCache) get(segment uint64, block int64) *keyBlock {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.segments[segment][block]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		return e.Value.(*cacheEntry).kb
+	}
+	c.misses++
+	return nil
+}
+
+func (c *blockCache) put(segment uint64, block int64, kb *keyBlock) {
+	if c == nil || kb.size > c.capacity {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	blocks, ok := c.segments[segment]
+	if !ok {
+		blocks = make(map[int64]*list.Element)
+		c.segments[segment] = blocks
+	}
+	if _, ok := blocks[block]; ok {
+		// read concurrently by another reader
+		return
+	}
+	blocks[block] = c.lru.PushFront(&cacheEntry{segment: segment, block: block, kb: kb})
+	c.size += kb.size
+
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removes the blocks of a segment, called when the segment is closed
+func (c *blockCache) remove(segment uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	for _, e := range c.segments[segment] {
+		c.removeElement(e)
+	}
+}
+
+func (c *blockCache) removeElement(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	c.size -= entry.kb.size
+	blocks := c.segments[entry.segment]
+	delete(blocks, entry.block)
+	if len(blocks) == 0 {
+		delete(c.segments, entry.segment)
+	}
+}
+
+func (c *blockCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Size: c.size}
+}
+
+// returns true if the value of the entry is a list of merge operands
+func (kb *keyBlock) operands(index int) bool {
+	return kb.flags != nil && kb.flags[index]&entryOperands != 0
+}
+
+// returns the time the value of the entry expires in unix nanoseconds, 0 if it does not expire
+func (kb *keyBlock) expiry(index int) int64 {
+	if kb.expires == nil {
+		return 0
+	}
+	return kb.expires[index]
+}
+
+// decodes a key block read from a key file of a segment with the version
+func decodeKeyBlock(buffer []byte, version uint8) (*keyBlock, error) {
+	kb := &keyBlock{}
+
+	entryLen := 12
+	if version >= entryFlagsVersion {
+		entryLen = 13
+	}
+
+	// the decoded keys share a single allocation, which is at least the size of the compressed keys
+	arena := make([]byte, 0, len(buffer))
+
+	index := 0
+	var prevKey []byte
+	for {
+		if index+2 > len(buffer) {
+			return nil, errCorruptBlock
+		}
+		keylen := binary.LittleEndian.Uint16(buffer[index:])
+		if keylen == endOfBlock {
+			break
+		}
+		prefixLen, compressedLen, err := decodeKeyLen(keylen)
+		if err != nil {
+			return nil, err
+		}
+		endkey := index + 2 + int(compressedLen)
+		if endkey+entryLen > len(buffer) || int(prefixLen) > len(prevKey) {
+			return nil, errCorruptBlock
+		}
+
+		start := len(arena)
+		arena = append(arena, prevKey[:prefixLen]...)
+		arena = append(arena, buffer[index+2:endkey]...)
+		key := arena[start:len(arena):len(arena)]
+
+		kb.keys = append(kb.keys, key)
+		kb.offsets = append(kb.offsets, int64(binary.LittleEndian.Uint64(buffer[endkey:])))
+		kb.lengths = append(kb.lengths, binary.LittleEndian.Uint32(buffer[endkey+8:]))
+		next := endkey + entryLen
+		if version >= entryFlagsVersion {
+			flags := buffer[endkey+12]
+			kb.flags = append(kb.flags, flags)
+
+			var expires int64
+			if version >= expiryVersion && flags&entryExpires != 0 {
+				if next+8 > len(buffer) {
+					return nil, errCorruptBlock
+				}
+				expires = int64(binary.LittleEndian.Uint64(buffer[next:]))
+				next += 8
+			}
+			if expires != 0 && kb.expires == nil {
+				kb.expires = make([]int64, len(kb.keys)-1, cap(kb.keys))
+			}
+			if kb.expires != nil {
+				kb.expires = append(kb.expires, expires)
+			}
+		}
+
+		prevKey = key
+		index = next
+	}
+
+	kb.size = int64(cap(arena)) + int64(len(kb.keys))*keyBlockEntrySize + int64(cap(kb.expires))*8
+	return kb, nil
+}
+
+// CacheStats returns the block cache statistics of the database
+func (db *Database) CacheStats() CacheStats {
+	return db.cache.stats()
+}
@@ -0,0 +1,61 @@
+package keydb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBlockCache(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	for i := 0; i < 10000; i++ {
+		m.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	itr, err := m.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := defaultSegmentOptions
+	options.cache = newBlockCache(64 * 1024)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, nil, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		value, err := ds.Get([]byte("mykey5000"))
+		if err != nil || string(value) != "myvalue5000" {
+			t.Fatal("unable to get by key", err)
+		}
+	}
+	stats := options.cache.stats()
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatal("second get should of been cached", stats)
+	}
+
+	itr, err = ds.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal("unable to lookup", err)
+	}
+	count := 0
+	for {
+		_, _, err := itr.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 10000 {
+		t.Fatal("incorrect count", count)
+	}
+	if stats = options.cache.stats(); stats.Size > 64*1024 {
+		t.Fatal("cache exceeds its capacity", stats)
+	}
+
+	ds.Close()
+	if stats = options.cache.stats(); stats.Size != 0 {
+		t.Fatal("closed segment should be removed from the cache", stats)
+	}
+}
@@ -0,0 +1,473 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/nightlyone/lockfile"
+)
+
+var errCorruptValue = errors.New("the value fails its checksum")
+
+// CheckProblem is a problem found by Check in a segment of a table
+type CheckProblem struct {
+	Table string
+	// the key file of the segment, or "" if the problem is with the table
+	Segment string
+	// the key block with the problem, or -1 if the problem is not in a key block
+	Block   int64
+	Problem string
+}
+
+func (p CheckProblem) String() string {
+	if p.Segment == "" {
+		return p.Problem
+	}
+	if p.Block < 0 {
+		return fmt.Sprint(p.Segment, ": ", p.Problem)
+	}
+	return fmt.Sprint(p.Segment, " block ", p.Block, ": ", p.Problem)
+}
+
+// CheckReport is the result of Check
+type CheckReport struct {
+	// the tables in the database, in order
+	Tables []string
+	// the number of segments and keys checked in each table
+	Segments map[string]int
+	Keys     map[string]int64
+	Problems []CheckProblem
+	// describes every segment rewritten by a repair
+	Repairs []string
+}
+
+// Check verifies the segment files of a database that is not open: the block structure and checksums of the key
+// files, the end of block markers, the prefix compression and order of the keys within and across blocks, the key
+// index, the value offsets and checksums and the range tombstones of the data files, and the bloom filters. the
+// options must have the comparators of the tables, as for OpenWithOptions, and a table with another comparator is
+// reported as a problem and not checked.
+//
+// if repair is true every segment with a problem is rewritten with the entries that could be read, and the keys
+// that could not be read are lost. the entries of a key block that fails its checksum are not trusted, and an older
+// value of a lost key may become visible
+func Check(path string, options Options, repair bool) (*CheckReport, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	dblock.Lock()
+	defer dblock.Unlock()
+
+	path = filepath.Clean(path)
+
+	err = IsValidDatabase(path)
+	if err != nil {
+		return nil, err
+	}
+
+	abs, err := filepath.Abs(path + "/lockfile")
+	if err != nil {
+		return nil, err
+	}
+	lf, err := lockfile.New(abs)
+	if err != nil {
+		return nil, err
+	}
+	err = lf.TryLock()
+	if err != nil {
+		return nil, DatabaseInUse
+	}
+	defer lf.Unlock()
+
+	// the manifest is read without the repairs made when the database is opened, so the files are not changed
+	// unless a segment is rewritten
+	m := &manifest{path: path, tables: make(map[string][]segmentInfo), comparators: make(map[string]string)}
+	f, err := os.Open(filepath.Join(path, manifestFilename))
+	if err == nil {
+		err = m.read(f)
+		f.Close()
+	} else if os.IsNotExist(err) {
+		err = m.importDirectory()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if m.file != nil {
+			m.close()
+		}
+	}()
+
+	report := &CheckReport{Tables: m.tableNames(), Segments: make(map[string]int), Keys: make(map[string]int64)}
+
+	for _, table := range report.Tables {
+		t := options.forTable(table)
+		expected, actual := m.comparator(table), t.comparator.Name()
+		if expected != actual {
+			// the order of the keys cannot be checked, the other tables are
+			err := &ComparatorError{Table: table, Expected: expected, Actual: actual}
+			report.Problems = append(report.Problems, CheckProblem{Table: table, Block: -1, Problem: err.Error() + ", the table was not checked"})
+			continue
+		}
+
+		for _, info := range m.segments(table) {
+			sc := &segmentCheck{table: table, info: info, cmp: t.comparator, keyIndexInterval: t.keyIndexInterval}
+			sc.check(path)
+			report.Segments[table]++
+			report.Keys[table] += int64(len(sc.entries))
+			report.Problems = append(report.Problems, sc.problems...)
+
+			if !repair || len(sc.problems) == 0 {
+				continue
+			}
+			if m.file == nil {
+				// the database was written before the manifest, so one is created to record the repair
+				if err := m.rewrite(); err != nil {
+					return report, err
+				}
+			}
+			options := segmentOptions{blockSize: t.keyBlockSize, keyIndexInterval: t.keyIndexInterval, bloomBitsPerKey: t.bloomBitsPerKey, sync: true, cmp: t.comparator}
+			repaired, err := sc.salvage(path, m, options)
+			if err != nil {
+				return report, err
+			}
+			report.Repairs = append(report.Repairs, repaired)
+		}
+	}
+
+	return report, nil
+}
+
+// segmentCheck verifies the files of a segment, and records the entries that can be read
+type segmentCheck struct {
+	table            string
+	info             segmentInfo
+	cmp              Comparator
+	keyIndexInterval int
+
+	keyFile  *os.File
+	dataFile *os.File
+	dataEnd  int64 // the end of the values in the data file
+	ranges   []Range
+	// the entries that can be read, in order
+	entries  []checkEntry
+	problems []CheckProblem
+}
+
+// an entry of a key block
+type checkEntry struct {
+	key     []byte
+	offset  int64
+	length  uint32
+	flags   uint8
+	expires int64
+}
+
+func (sc *segmentCheck) problem(block int64, format string, args ...interface{}) {
+	sc.problems = append(sc.problems, CheckProblem{Table: sc.table, Segment: sc.info.keyFile, Block: block, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (sc *segmentCheck) check(dbpath string) {
+	var err error
+	sc.keyFile, err = os.Open(filepath.Join(dbpath, sc.info.keyFile))
+	if err != nil {
+		sc.problem(-1, "unable to open the key file: %v", err)
+		return
+	}
+	defer sc.keyFile.Close()
+	sc.dataFile, err = os.Open(filepath.Join(dbpath, sc.info.dataFile))
+	if err != nil {
+		sc.problem(-1, "unable to open the data file: %v", err)
+		return
+	}
+	defer sc.dataFile.Close()
+
+	kfi, err0 := sc.keyFile.Stat()
+	dfi, err1 := sc.dataFile.Stat()
+	if err := errn(err0, err1); err != nil {
+		sc.problem(-1, "unable to read the segment files: %v", err)
+		return
+	}
+
+	sc.dataEnd = dfi.Size()
+	if sc.info.version >= rangeTombstoneVersion {
+		sc.ranges, err = readRangeTombstones(sc.dataFile, dfi.Size())
+		if err != nil {
+			sc.problem(-1, "the range tombstones at the end of the data file are corrupt")
+		} else {
+			sc.dataEnd -= int64(len(encodeRangeTombstones(sc.ranges)))
+		}
+	}
+
+	blockSize := int64(sc.info.blockSize)
+	if kfi.Size()%blockSize != 0 {
+		sc.problem(-1, "the key file size %d is not a multiple of the block size %d", kfi.Size(), blockSize)
+	}
+	blocks := kfi.Size() / blockSize
+
+	var prevKey []byte
+	var nextOffset int64
+	var indexKeys [][]byte
+	buffer := make([]byte, blockSize)
+	for block := int64(0); block < blocks; block++ {
+		if _, err := sc.keyFile.ReadAt(buffer, block*blockSize); err != nil {
+			sc.problem(block, "unable to read the block: %v", err)
+			break
+		}
+		if sc.info.version >= checksumVersion {
+			checksum := binary.LittleEndian.Uint32(buffer[blockSize-checksumLen:])
+			if crc32.Checksum(buffer[:blockSize-checksumLen], crcTable) != checksum {
+				sc.problem(block, "the block fails its checksum")
+				continue
+			}
+		}
+
+		entries := sc.decodeBlock(block, buffer)
+		if len(entries) == 0 {
+			continue
+		}
+
+		if block%int64(sc.keyIndexInterval) == 0 {
+			// the key index is loaded from the first key of the block without decoding the block
+			keylen := binary.LittleEndian.Uint16(buffer)
+			if keylen&compressedBit != 0 || int(keylen) != len(entries[0].key) {
+				sc.problem(block, "the first key of the block is compressed, so the key index is wrong")
+			} else if len(indexKeys) > 0 && !lessKeys(sc.cmp, indexKeys[len(indexKeys)-1], entries[0].key) {
+				sc.problem(block, "the key index entry %q is not after the previous entry", entries[0].key)
+			}
+			indexKeys = append(indexKeys, entries[0].key)
+		}
+
+		for i, e := range entries {
+			if prevKey != nil && !lessKeys(sc.cmp, prevKey, e.key) {
+				if i == 0 {
+					sc.problem(block, "the first key %q is not after the last key of the previous block", e.key)
+				} else {
+					sc.problem(block, "the key %q is not after the previous key", e.key)
+				}
+				continue
+			}
+			if e.length != removedKeyLen {
+				end := e.offset + int64(e.length)
+				if sc.info.version >= checksumVersion {
+					end += checksumLen
+				}
+				if e.offset < 0 || end > sc.dataEnd {
+					sc.problem(block, "the value of key %q at offset %d length %d is past the end of the data, at %d", e.key, e.offset, e.length, sc.dataEnd)
+					continue
+				}
+				if e.offset < nextOffset {
+					sc.problem(block, "the value of key %q at offset %d overlaps the previous value", e.key, e.offset)
+					continue
+				}
+				if _, err := sc.readValue(e); err != nil {
+					sc.problem(block, "the value of key %q at offset %d: %v", e.key, e.offset, err)
+					continue
+				}
+				nextOffset = end
+			}
+			prevKey = e.key
+			sc.entries = append(sc.entries, e)
+		}
+	}
+
+	if nextOffset < sc.dataEnd && sc.info.version >= checksumVersion {
+		sc.problem(-1, "%d bytes of values at the end of the data file are not referenced by a key", sc.dataEnd-nextOffset)
+	}
+
+	if filter := readBloomFilter(bloomFilename(filepath.Join(dbpath, sc.info.keyFile))); filter != nil {
+		for _, e := range sc.entries {
+			if !filter.mayContain(e.key) {
+				sc.problem(-1, "the key %q is not in the bloom filter", e.key)
+			}
+		}
+	} else if _, err := os.Stat(bloomFilename(filepath.Join(dbpath, sc.info.keyFile))); err == nil {
+		sc.problem(-1, "the bloom filter is corrupt")
+	}
+}
+
+// decodes a key block that passed its checksum, returning the entries before the first problem
+func (sc *segmentCheck) decodeBlock(block int64, buffer []byte) []checkEntry {
+	limit := len(buffer)
+	if sc.info.version >= checksumVersion {
+		limit -= checksumLen
+	}
+	entryLen := 12
+	if sc.info.version >= entryFlagsVersion {
+		entryLen = 13
+	}
+
+	var entries []checkEntry
+	var prevKey []byte
+	index := 0
+	for {
+		if index+2 > limit {
+			sc.problem(block, "the block has no end of block marker")
+			return entries
+		}
+		keylen := binary.LittleEndian.Uint16(buffer[index:])
+		if keylen == endOfBlock {
+			break
+		}
+		prefixLen, compressedLen, err := decodeKeyLen(keylen)
+		if err != nil {
+			sc.problem(block, "invalid key length at offset %d: %v", index, err)
+			return entries
+		}
+		if int(prefixLen) > len(prevKey) {
+			sc.problem(block, "the compressed key at offset %d has a prefix of %d bytes, longer than the previous key", index, prefixLen)
+			return entries
+		}
+		if int(prefixLen)+int(compressedLen) > maxKeySize {
+			sc.problem(block, "the key at offset %d is longer than %d bytes", index, maxKeySize)
+			return entries
+		}
+		endkey := index + 2 + int(compressedLen)
+		if endkey+entryLen > limit {
+			sc.problem(block, "the entry at offset %d extends past the end of the block", index)
+			return entries
+		}
+
+		var e checkEntry
+		e.key = append(append([]byte(nil), prevKey[:prefixLen]...), buffer[index+2:endkey]...)
+		e.offset = int64(binary.LittleEndian.Uint64(buffer[endkey:]))
+		e.length = binary.LittleEndian.Uint32(buffer[endkey+8:])
+		next := endkey + entryLen
+		if sc.info.version >= entryFlagsVersion {
+			e.flags = buffer[endkey+12]
+			if e.flags&^(entryOperands|entryExpires) != 0 || (e.flags&entryExpires != 0 && sc.info.version < expiryVersion) {
+				sc.problem(block, "the entry at offset %d has unknown flags %#x", index, e.flags)
+				return entries
+			}
+			if e.flags&entryExpires != 0 {
+				if next+8 > limit {
+					sc.problem(block, "the entry at offset %d extends past the end of the block", index)
+					return entries
+				}
+				e.expires = int64(binary.LittleEndian.Uint64(buffer[next:]))
+				next += 8
+			}
+		}
+
+		entries = append(entries, e)
+		prevKey = e.key
+		index = next
+	}
+
+	if len(entries) == 0 {
+		sc.problem(block, "the block is empty")
+	}
+	return entries
+}
+
+// reads the value of an entry, verifying its checksum if the segment has them
+func (sc *segmentCheck) readValue(e checkEntry) ([]byte, error) {
+	if e.length == removedKeyLen {
+		return nil, nil
+	}
+	n := int(e.length)
+	if sc.info.version >= checksumVersion {
+		n += checksumLen
+	}
+	buffer := make([]byte, n)
+	if _, err := sc.dataFile.ReadAt(buffer, e.offset); err != nil {
+		return nil, err
+	}
+	if sc.info.version >= checksumVersion && crc32.Checksum(buffer[:e.length], crcTable) != binary.LittleEndian.Uint32(buffer[e.length:]) {
+		return nil, errCorruptValue
+	}
+	return buffer[:e.length:e.length], nil
+}
+
+// rewrites the segment with the entries that could be read, replacing it in the manifest. the segment keeps its
+// range of ids, so it keeps its place in the table. returns a description of the repair
+func (sc *segmentCheck) salvage(dbpath string, m *manifest, options segmentOptions) (string, error) {
+	base := filepath.Join(dbpath, sc.table+".merged."+strconv.FormatUint(sc.info.low, 10))
+	sid := strconv.FormatUint(sc.info.id, 10)
+	var keyFilename, dataFilename string
+	for {
+		sseq := strconv.FormatUint(atomic.AddUint64(&mergeSeq, 1), 10)
+		keyFilename = base + "." + sseq + ".keys." + sid
+		dataFilename = base + "." + sseq + ".data." + sid
+		if _, err := os.Stat(keyFilename); os.IsNotExist(err) {
+			break
+		}
+	}
+
+	var err error
+	sc.keyFile, err = os.Open(filepath.Join(dbpath, sc.info.keyFile))
+	if err != nil {
+		return "", err
+	}
+	defer sc.keyFile.Close()
+	sc.dataFile, err = os.Open(filepath.Join(dbpath, sc.info.dataFile))
+	if err != nil {
+		return "", err
+	}
+	defer sc.dataFile.Close()
+
+	changes := []manifestChange{{op: removeSegment, table: sc.table, info: sc.info}}
+	seg, err := writeAndLoadSegment(keyFilename, dataFilename, &salvageIterator{sc: sc}, sc.ranges, options)
+	if err != nil && err != errEmptySegment {
+		return "", err
+	}
+	description := fmt.Sprint("removed segment ", sc.info.keyFile, " of table ", sc.table, " which has no readable keys")
+	if seg != nil {
+		changes = append(changes, manifestChange{op: addSegment, table: sc.table, info: newSegmentInfo(seg.(*diskSegment))})
+		description = fmt.Sprint("rewrote segment ", sc.info.keyFile, " of table ", sc.table, " as ", filepath.Base(keyFilename), " with ", len(sc.entries), " keys")
+		if err := seg.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := m.apply(changes, true); err != nil {
+		return "", err
+	}
+
+	// the manifest no longer refers to the files of the segment
+	err0 := os.Remove(filepath.Join(dbpath, sc.info.keyFile))
+	err1 := os.Remove(filepath.Join(dbpath, sc.info.dataFile))
+	err2 := removeBloomFilter(filepath.Join(dbpath, sc.info.keyFile))
+	return description, errn(err0, err1, err2)
+}
+
+// salvageIterator returns the entries of a segment that could be read
+type salvageIterator struct {
+	sc    *segmentCheck
+	index int
+	entry checkEntry
+}
+
+func (si *salvageIterator) Next() (key []byte, value []byte, err error) {
+	if si.index >= len(si.sc.entries) {
+		return nil, nil, EndOfIterator
+	}
+	si.entry = si.sc.entries[si.index]
+	si.index++
+	value, err = si.sc.readValue(si.entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	return si.entry.key, value, nil
+}
+
+func (si *salvageIterator) peekKey() ([]byte, error) {
+	if si.index >= len(si.sc.entries) {
+		return nil, EndOfIterator
+	}
+	return si.sc.entries[si.index].key, nil
+}
+
+func (si *salvageIterator) operands() bool {
+	return si.entry.flags&entryOperands != 0
+}
+
+func (si *salvageIterator) expiry() int64 {
+	return si.entry.expires
+}
@@ -0,0 +1,128 @@
+package keydb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// returns the key and data file of the only segment of the table
+func checkTestSegment(t *testing.T, path string, table string) (string, string) {
+	m := &manifest{path: path, tables: make(map[string][]segmentInfo), comparators: make(map[string]string)}
+	f, err := os.Open(filepath.Join(path, manifestFilename))
+	if err != nil {
+		t.Fatal("unable to open manifest", err)
+	}
+	defer f.Close()
+	if err = m.read(f); err != nil {
+		t.Fatal("unable to read manifest", err)
+	}
+	segments := m.segments(table)
+	if len(segments) != 1 {
+		t.Fatal("expected a single segment", segments)
+	}
+	return filepath.Join(path, segments[0].keyFile), filepath.Join(path, segments[0].dataFile)
+}
+
+// flips a byte of the file
+func corruptFile(t *testing.T, filename string, offset int64) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal("unable to open file", err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, offset)
+	b[0] ^= 0xFF
+	if _, err = f.WriteAt(b, offset); err != nil {
+		t.Fatal("unable to write file", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	Remove("test/mydb")
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 1000; i++ {
+		tx.Put([]byte(fmt.Sprintf("mykey%04d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	report, err := Check("test/mydb", Options{}, false)
+	if err != nil {
+		t.Fatal("unable to check database", err)
+	}
+	if len(report.Problems) != 0 || report.Segments["main"] != 1 || report.Keys["main"] != 1000 {
+		t.Fatal("incorrect report", report.Problems, report.Segments, report.Keys)
+	}
+
+	// the first value is corrupt
+	keyFilename, dataFilename := checkTestSegment(t, "test/mydb", "main")
+	corruptFile(t, dataFilename, 0)
+	report, err = Check("test/mydb", Options{}, false)
+	if err != nil {
+		t.Fatal("unable to check database", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Block != 0 || report.Keys["main"] != 999 {
+		t.Fatal("incorrect report", report.Problems, report.Keys)
+	}
+
+	// the second key block is corrupt
+	corruptFile(t, keyFilename, defaultKeyBlockSize+10)
+	report, err = Check("test/mydb", Options{}, true)
+	if err != nil {
+		t.Fatal("unable to repair database", err)
+	}
+	if len(report.Problems) < 2 || report.Problems[1].Block != 1 || len(report.Repairs) != 1 {
+		t.Fatal("incorrect report", report.Problems, report.Repairs)
+	}
+	keys := report.Keys["main"]
+
+	report, err = Check("test/mydb", Options{}, false)
+	if err != nil {
+		t.Fatal("unable to check database", err)
+	}
+	if len(report.Problems) != 0 || report.Keys["main"] != keys {
+		t.Fatal("the repaired segment has problems", report.Problems, report.Keys)
+	}
+
+	db, err = Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	itr, err := db.BeginReadTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if _, err := itr.Get([]byte("mykey0000")); err != KeyNotFound {
+		t.Fatal("the corrupt key should be removed", err)
+	}
+	if value, err := itr.Get([]byte("mykey0999")); err != nil || string(value) != "myvalue999" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	found := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := itr.Get([]byte(fmt.Sprintf("mykey%04d", i))); err == nil {
+			found++
+		}
+	}
+	if int64(found) != keys {
+		t.Fatal("wrong number of keys", found, keys)
+	}
+	itr.Commit()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
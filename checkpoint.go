@@ -0,0 +1,193 @@
+package keydb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Checkpoint writes a consistent copy of the database to dir, which must not exist, while the database remains in use.
+// it waits for the open write transactions to complete and the committed segments to be written, delaying new write
+// transactions until then, and pauses the merger while the segment files are linked into dir, or copied if they cannot
+// be linked. the segment files are immutable, so the checkpoint shares them with the database until they are merged.
+// dir can be opened like any database, and contains every commit completed before Checkpoint was called, including
+// the tables that were created with a comparator the database was not opened with
+func (db *Database) Checkpoint(dir string) error {
+	// the merge locks keep the segment files, so the database can be used while they are linked
+	tables, _, err := db.quiesceTables()
+	if err != nil {
+		return err
+	}
+	defer releaseTables(tables)
+
+	if err := os.Mkdir(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	checkpoint := &manifest{path: dir, tables: make(map[string][]segmentInfo), comparators: make(map[string]string)}
+
+	err = func() error {
+		for _, t := range tables {
+			checkpoint.comparators[t.name] = db.manifest.comparator(t.name)
+			for _, info := range t.segments {
+				err0 := linkOrCopy(filepath.Join(db.path, info.keyFile), filepath.Join(dir, info.keyFile))
+				err1 := linkOrCopy(filepath.Join(db.path, info.dataFile), filepath.Join(dir, info.dataFile))
+				// the bloom filter is optional
+				err2 := linkOrCopy(filepath.Join(db.path, bloomFilename(info.keyFile)), filepath.Join(dir, bloomFilename(info.keyFile)))
+				if os.IsNotExist(err2) {
+					err2 = nil
+				}
+				if err := errn(err0, err1, err2); err != nil {
+					return err
+				}
+				checkpoint.tables[t.name] = append(checkpoint.tables[t.name], info)
+			}
+		}
+		if err := checkpoint.rewrite(); err != nil {
+			return err
+		}
+		return checkpoint.close()
+	}()
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+// the live segments of a table returned by quiesceTables
+type quiescedTable struct {
+	name     string
+	segments []segmentInfo
+	// nil if the table was created with another comparator. it cannot be loaded, so its segments cannot change
+	it *internalTable
+}
+
+// waits until no table has open write transactions or segments waiting to be written, and none is being merged,
+// returning every table with its merge lock held, see releaseTables, and the highest segment id allocated. new write
+// transactions wait until it returns, so the open ones complete even under a steady load. the tables are checked
+// together, so the segments of every table are from the same point in the commit order, and include every segment id
+// up to the highest. the database must not be locked
+func (db *Database) quiesceTables() ([]quiescedTable, uint64, error) {
+	atomic.AddInt32(&db.quiescing, 1)
+	defer atomic.AddInt32(&db.quiescing, -1)
+
+	for {
+		db.Lock()
+		if db.err != nil {
+			db.Unlock()
+			return nil, 0, db.err
+		}
+		if db.closing {
+			db.Unlock()
+			return nil, 0, DatabaseClosed
+		}
+		var tables []quiescedTable
+		var loaded []*internalTable
+		for _, name := range db.manifest.tableNames() {
+			if db.checkComparator(name) != nil {
+				tables = append(tables, quiescedTable{name: name, segments: db.manifest.segments(name)})
+				continue
+			}
+			it, err := db.getTable(name)
+			if err != nil {
+				db.Unlock()
+				return nil, 0, err
+			}
+			tables = append(tables, quiescedTable{name: name, it: it})
+			loaded = append(loaded, it)
+		}
+		ok := quiesced(loaded)
+		db.Unlock()
+
+		if !ok {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		// no transaction is open and none can begin, so a running merge is not waiting for one, and finishes without
+		// the database lock. the merge locks are taken without it, so the database can be used until they are held
+		for _, it := range loaded {
+			it.merge.Lock()
+		}
+		for _, it := range loaded {
+			it.Lock()
+		}
+		// a commit allocates its segment id and adds the segment while holding the table lock
+		maxID := atomic.LoadUint64(&db.nextSegID)
+		dropped := false
+		for i := range tables {
+			it := tables[i].it
+			if it == nil {
+				continue
+			}
+			// a table dropped or renamed since it was checked is not in the list of tables
+			dropped = dropped || it.dropped
+			for _, s := range it.segments {
+				tables[i].segments = append(tables[i].segments, newSegmentInfo(s.(*diskSegment)))
+			}
+			it.Unlock()
+		}
+
+		if !dropped {
+			return tables, maxID, nil
+		}
+		releaseTables(tables)
+	}
+}
+
+// releases the merge locks held by quiesceTables
+func releaseTables(tables []quiescedTable) {
+	for _, t := range tables {
+		if t.it != nil {
+			t.it.merge.Unlock()
+		}
+	}
+}
+
+// reports whether no table has an open write transaction or segments waiting to be written. the merger holds the
+// merge lock while it waits for the transactions of the table, so the merge locks cannot be taken until there are none
+func quiesced(tables []*internalTable) bool {
+	for _, it := range tables {
+		it.Lock()
+		busy := it.transactions > 0
+		for _, s := range it.segments {
+			if _, ok := s.(*diskSegment); !ok {
+				busy = true
+			}
+		}
+		it.Unlock()
+		if busy {
+			return false
+		}
+	}
+	return true
+}
+
+// creates a hard link to the file, or a synced copy of it if the link fails, e.g. because to is on another device
+func linkOrCopy(from, to string) error {
+	err := os.Link(from, to)
+	if err == nil || os.IsNotExist(err) {
+		return err
+	}
+	return copyFile(from, to)
+}
+
+// copies the file to a new file, and syncs it
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(to, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err0 := io.Copy(out, in)
+	err1 := out.Sync()
+	err2 := out.Close()
+	return errn(err0, err1, err2)
+}
@@ -0,0 +1,170 @@
+package keydb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckpointDuringMerge(t *testing.T) {
+	Remove("test/mydb")
+	os.RemoveAll("test/checkpoint")
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 3; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	// the merge waits for the open transaction while holding the merge lock
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	db.Lock()
+	table, err := db.getTable("main")
+	db.Unlock()
+	if err != nil {
+		t.Fatal("unable to load table", err)
+	}
+	merged := make(chan error, 1)
+	go func() {
+		merged <- mergeTableSegments(db, table, 1)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	checkpointed := make(chan error, 1)
+	go func() {
+		checkpointed <- db.Checkpoint("test/checkpoint")
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	committed := make(chan error, 1)
+	go func() {
+		tx.Put([]byte("mykey3"), []byte("myvalue3"))
+		committed <- tx.Commit()
+	}()
+
+	for _, c := range []chan error{committed, merged, checkpointed} {
+		select {
+		case err := <-c:
+			if err != nil {
+				t.Fatal("unable to commit, merge or checkpoint", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("deadlock between the commit, merge and checkpoint")
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	cp, err := Open("test/checkpoint", false)
+	if err != nil {
+		t.Fatal("unable to open checkpoint", err)
+	}
+	itr, err := cp.BeginReadTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 3; i++ {
+		if value, err := itr.Get([]byte(fmt.Sprint("mykey", i))); err != nil || string(value) != fmt.Sprint("myvalue", i) {
+			t.Fatal("incorrect value", string(value), err)
+		}
+	}
+	itr.Commit()
+	if err = cp.Close(); err != nil {
+		t.Fatal("unable to close checkpoint", err)
+	}
+	os.RemoveAll("test/checkpoint")
+}
+
+func TestCheckpointDelaysWriters(t *testing.T) {
+	Remove("test/mydb")
+	os.RemoveAll("test/checkpoint")
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey0"), []byte("myvalue0"))
+
+	checkpointed := make(chan error, 1)
+	go func() {
+		checkpointed <- db.Checkpoint("test/checkpoint")
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// a new write transaction waits for the checkpoint, so the open ones complete under a steady load
+	begun := make(chan *Transaction, 1)
+	go func() {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Error("unable to create transaction", err)
+		}
+		begun <- tx
+	}()
+	select {
+	case <-begun:
+		t.Fatal("the transaction should wait for the checkpoint")
+	case <-time.After(200 * time.Millisecond):
+	}
+	// read only transactions do not wait
+	itr, err := db.BeginReadTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	itr.Commit()
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	select {
+	case err := <-checkpointed:
+		if err != nil {
+			t.Fatal("unable to checkpoint", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the checkpoint did not complete")
+	}
+	tx = <-begun
+	tx.Put([]byte("mykey1"), []byte("myvalue1"))
+	if err = tx.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	cp, err := Open("test/checkpoint", false)
+	if err != nil {
+		t.Fatal("unable to open checkpoint", err)
+	}
+	itr, err = cp.BeginReadTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := itr.Get([]byte("mykey0")); err != nil || string(value) != "myvalue0" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	if _, err := itr.Get([]byte("mykey1")); err != KeyNotFound {
+		t.Fatal("the later commit should not be in the checkpoint", err)
+	}
+	itr.Commit()
+	if err = cp.Close(); err != nil {
+		t.Fatal("unable to close checkpoint", err)
+	}
+	os.RemoveAll("test/checkpoint")
+}
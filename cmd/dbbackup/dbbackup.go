@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"keydb"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// back up a database to a directory, or restore it from a chain of backups, see keydb.Database.Backup
+func main() {
+	path := flag.String("path", "", "set the database path")
+	out := flag.String("out", "", "set the backup directory, which must not exist")
+	previous := flag.String("previous", "", "set the directory of the previous backup, for an incremental backup")
+	restore := flag.String("restore", "", "restore the database from a comma separated list of backup directories, starting with the full backup")
+
+	flag.Parse()
+
+	if *path == "" || (*out == "") == (*restore == "") {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	dbpath := filepath.Clean(*path)
+
+	if *restore != "" {
+		err := keydb.Restore(dbpath, strings.Split(*restore, ",")...)
+		if err != nil {
+			log.Fatal("unable to restore ", err)
+		}
+		return
+	}
+
+	db, err := keydb.Open(dbpath, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = db.Backup(*out, *previous)
+	if err != nil {
+		db.Close()
+		log.Fatal("unable to backup ", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
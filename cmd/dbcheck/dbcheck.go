@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"keydb"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// verify the segment files of a database that is not open, and optionally repair them, see keydb.Check
+func main() {
+	path := flag.String("path", "", "set the database path")
+	repair := flag.Bool("repair", false, "rewrite every segment with problems with the entries that can be read")
+
+	flag.Parse()
+
+	if *path == "" {
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	report, err := keydb.Check(filepath.Clean(*path), keydb.Options{}, *repair)
+	if report == nil {
+		log.Fatal("unable to check database ", err)
+	}
+
+	for _, table := range report.Tables {
+		var problems []keydb.CheckProblem
+		for _, p := range report.Problems {
+			if p.Table == table {
+				problems = append(problems, p)
+			}
+		}
+		status := "ok"
+		if len(problems) > 0 {
+			status = fmt.Sprint(len(problems), " problems")
+		}
+		fmt.Printf("table %s: %d segments, %d keys, %s\n", table, report.Segments[table], report.Keys[table], status)
+		for _, p := range problems {
+			fmt.Println("\t" + p.String())
+		}
+	}
+	for _, r := range report.Repairs {
+		fmt.Println(r)
+	}
+
+	if err != nil {
+		log.Fatal("unable to repair database ", err)
+	}
+	if len(report.Problems) > 0 && !*repair {
+		os.Exit(1)
+	}
+}
@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bufio"
 	"flag"
-	"fmt"
-	"html"
-	"io/ioutil"
+	"io"
 	"keydb"
 	"log"
 	"os"
@@ -13,23 +10,20 @@ import (
 	"strings"
 )
 
-// dump a database to stdout
+// dump a database to a file or stdout, see keydb.Database.Dump
 func main() {
 	path := flag.String("path", "", "set the database path")
-	out := flag.String("out", "dbdump.xml", "set output file")
+	out := flag.String("out", "dbdump.xml", "set output file, - for stdout")
+	format := flag.String("format", "xml", "set the dump format, xml, binary, jsonl or csv")
+	encoding := flag.String("encoding", "base64", "set the encoding of the keys and values of a text dump, base64, hex or utf8")
+	tables := flag.String("tables", "", "set a comma separated list of the tables to dump, default all")
+	lower := flag.String("lower", "", "set the lowest key to dump, in the encoding")
+	upper := flag.String("upper", "", "set the highest key to dump, in the encoding")
 
 	flag.Parse()
 
 	dbpath := filepath.Clean(*path)
 
-	outfile, err := os.Create(*out)
-	if err != nil {
-		log.Fatal("unable to open output file ", err)
-	}
-	defer outfile.Close()
-
-	w := bufio.NewWriter(outfile)
-
 	fi, err := os.Stat(dbpath)
 	if err != nil {
 		log.Fatalln("unable to open database directory", err)
@@ -39,9 +33,15 @@ func main() {
 		log.Fatalln("path is not a directory")
 	}
 
-	tables := findTableNames(dbpath)
-	if tables == nil || len(tables) == 0 {
-		log.Fatal("database contains zero tables")
+	options := keydb.DumpOptions{Format: keydb.DumpFormat(*format), Encoding: *encoding}
+	if *tables != "" {
+		options.Tables = strings.Split(*tables, ",")
+	}
+	if options.Range.Lower, err = keydb.DecodeDumpKey(*encoding, *lower); err != nil {
+		log.Fatal("unable to decode key ", *lower, " ", err)
+	}
+	if options.Range.Upper, err = keydb.DecodeDumpKey(*encoding, *upper); err != nil {
+		log.Fatal("unable to decode key ", *upper, " ", err)
 	}
 
 	db, err := keydb.Open(dbpath, false)
@@ -49,58 +49,46 @@ func main() {
 		log.Fatal(err)
 	}
 
-	fmt.Fprintf(w, "<db path=\"%s\">\n", html.EscapeString(dbpath))
-	for _, v := range tables {
-		name := v
-		fmt.Fprintf(w, "\t<tabledata name=\"%s\">\n", name)
-		tx, err := db.BeginTX(name)
-		if err != nil {
-			log.Fatal("unable to open tx on ", v, " ", err)
-		}
-		itr, err := tx.Lookup(nil, nil)
+	names, err := db.ListTables()
+	if err != nil {
+		db.Close()
+		log.Fatal("unable to list tables ", err)
+	}
+	if len(names) == 0 {
+		db.Close()
+		log.Fatal("database contains zero tables")
+	}
+
+	var w io.Writer = os.Stdout
+	var outfile *os.File
+	if *out != "-" {
+		outfile, err = os.Create(*out)
 		if err != nil {
-			log.Fatal("unable to open iterator on ", name, " ", err)
-		}
-		for {
-			if key, value, err := itr.Next(); err == nil {
-				fmt.Fprintf(w, "\t\t<entry><key>%s</key> <value>%s</value></entry>\n", html.EscapeString(string(key)), html.EscapeString(string(value)))
-			} else {
-				if err == keydb.EndOfIterator {
-					break
-				}
-				if err != nil {
-					log.Fatal("error processing table ", name)
-				}
-			}
+			db.Close()
+			log.Fatal("unable to open output file ", err)
 		}
-		fmt.Fprintln(w, "\t</tabledata>")
+		w = outfile
 	}
-	fmt.Fprintln(w, "</db>")
 
-	err = w.Flush()
+	err = db.Dump(w, options)
+	if e, ok := err.(*keydb.ComparatorError); ok {
+		// the comparators of the tables are not known to this tool
+		db.Close()
+		log.Fatal("unable to dump table ", e.Table, " which uses comparator ", e.Expected, ", use -tables to dump the other tables")
+	}
 	if err != nil {
-		log.Fatal("unable to flush writer, io errors,", err)
+		db.Close()
+		log.Fatal("unable to dump database ", err)
 	}
-}
-
-func findTableNames(dbpath string) []string {
-	names := make(map[string]bool)
 
-	infos, err := ioutil.ReadDir(dbpath)
+	err = db.Close()
 	if err != nil {
-		log.Fatal("unable to read directory", err)
+		log.Fatal(err)
 	}
-
-	for _, fi := range infos {
-		if strings.Index(fi.Name(), ".keys.") >= 0 {
-			table := strings.Split(fi.Name(), ".")[0]
-			names[table] = true
+	if outfile != nil {
+		err = outfile.Close()
+		if err != nil {
+			log.Fatal("unable to close output file, io errors,", err)
 		}
 	}
-	var namesS []string
-	for k := range names {
-		namesS = append(namesS, k)
-
-	}
-	return namesS
 }
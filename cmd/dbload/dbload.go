@@ -1,21 +1,24 @@
 package main
 
 import (
-	"bufio"
-	"encoding/hex"
-	"encoding/xml"
 	"flag"
+	"io"
 	"keydb"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
 )
 
-// load a database a dbdump file
+// load a database from a dbdump file or stdin, see keydb.Database.Load
 func main() {
 	path := flag.String("path", "", "set the database path")
-	in := flag.String("in", "dbdump.xml", "set the input file")
+	in := flag.String("in", "dbdump.xml", "set the input file, - for stdin")
+	format := flag.String("format", "", "set the dump format, xml, binary, jsonl or csv. xml and binary are detected if not set")
+	encoding := flag.String("encoding", "base64", "set the encoding of the keys and values of a jsonl or csv dump, base64, hex or utf8")
+	tables := flag.String("tables", "", "set a comma separated list of the tables to load, default all")
+	lower := flag.String("lower", "", "set the lowest key to load, in the encoding")
+	upper := flag.String("upper", "", "set the highest key to load, in the encoding")
 	remove := flag.Bool("remove", true, "remove existing db if it exists")
 	create := flag.Bool("create", true, "create database if it doesn't exist")
 
@@ -28,99 +31,48 @@ func main() {
 
 	dbpath := filepath.Clean(*path)
 
-	infile, err := os.Open(*in)
-	if err != nil {
-		log.Fatal("unable to open input file ", err)
+	options := keydb.DumpOptions{Format: keydb.DumpFormat(*format), Encoding: *encoding}
+	if *tables != "" {
+		options.Tables = strings.Split(*tables, ",")
+	}
+	var err error
+	if options.Range.Lower, err = keydb.DecodeDumpKey(*encoding, *lower); err != nil {
+		log.Fatal("unable to decode key ", *lower, " ", err)
+	}
+	if options.Range.Upper, err = keydb.DecodeDumpKey(*encoding, *upper); err != nil {
+		log.Fatal("unable to decode key ", *upper, " ", err)
 	}
-	defer infile.Close()
 
-	if *remove {
-		err = keydb.Remove(dbpath)
-		if err != keydb.NoDatabaseFound {
-			log.Fatal("unable to remove ")
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		infile, err := os.Open(*in)
+		if err != nil {
+			log.Fatal("unable to open input file ", err)
 		}
+		defer infile.Close()
+		r = infile
 	}
 
-	r := bufio.NewReader(infile)
-
-	var asStrings bool
-
-	var db *keydb.Database
-
-	decoder := xml.NewDecoder(r)
-	var tx *keydb.Transaction
-
-	type EntryElement struct {
-		Key   string `xml:"key"`
-		Value string `xml:"value"`
+	if *remove {
+		err := keydb.Remove(dbpath)
+		if err != nil && err != keydb.NoDatabaseFound {
+			log.Fatal("unable to remove ", err)
+		}
 	}
 
-	db, err = keydb.Open(dbpath, *create)
+	db, err := keydb.Open(dbpath, *create)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
 
-	var inElement string
-	for {
-		// Read tokens from the XML document in a stream.
-		t, _ := decoder.Token()
-		if t == nil {
-			break
-		}
-		// Inspect the type of the token just read.
-		switch se := t.(type) {
-		case xml.StartElement:
-			// If we just read a StartElement token
-			inElement = se.Name.Local
-			// ...and its name is "page"
-			if inElement == "db" {
-				asStrings, _ = strconv.ParseBool(getAttr("strings", se.Attr))
-			} else if inElement == "tabledata" {
-				tx, err = db.BeginTX(getAttr("name", se.Attr))
-				if err != nil {
-					log.Fatal(err)
-				}
-			} else if inElement == "entry" {
-				e := EntryElement{}
-
-				decoder.DecodeElement(&e, &se)
-
-				if asStrings {
-					err := tx.Put([]byte(e.Key), []byte(e.Value))
-					if err != nil {
-						log.Fatal(err)
-					}
-				} else {
-					key, _ := hex.DecodeString(e.Key)
-					value, _ := hex.DecodeString(e.Key)
-					err := tx.Put(key, value)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
-			}
-		case xml.EndElement:
-			outElement := se.Name.Local
-			if outElement == "tabledata" {
-				tx.Commit()
-			}
-		default:
-		}
-
+	err = db.Load(r, options)
+	if err != nil {
+		db.Close()
+		log.Fatal("unable to load dump ", err)
 	}
 
 	err = db.Close()
 	if err != nil {
-		panic(err)
-	}
-
-}
-
-func getAttr(name string, attrs []xml.Attr) string {
-	for _, v := range attrs {
-		if v.Name.Local == name {
-			return v.Value
-		}
+		log.Fatal(err)
 	}
-	return ""
 }
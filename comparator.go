@@ -0,0 +1,45 @@
+package keydb
+
+import "bytes"
+
+// Comparator orders the keys of a table. the name of the comparator is recorded when a table is created, and the
+// table can only be used with a comparator of the same name, since the segments on disk are in its order.
+// Compare must return 0 only if the keys are identical
+type Comparator interface {
+	// Name identifies the order of the keys, it must change if the order changes
+	Name() string
+	// Compare returns -1 if a < b, 0 if a == b, or 1 if a > b
+	Compare(a, b []byte) int
+}
+
+// BytewiseComparator orders the keys lexicographically, it is the default comparator
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string {
+	return "keydb.BytewiseComparator"
+}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// compares the keys with cmp, or bytewise if cmp is nil
+func compareKeys(cmp Comparator, a, b []byte) int {
+	if cmp == nil {
+		return bytes.Compare(a, b)
+	}
+	return cmp.Compare(a, b)
+}
+
+func lessKeys(cmp Comparator, a, b []byte) bool {
+	return compareKeys(cmp, a, b) < 0
+}
+
+func equalKeys(cmp Comparator, a, b []byte) bool {
+	if cmp == nil {
+		return bytes.Equal(a, b)
+	}
+	return cmp.Compare(a, b) == 0
+}
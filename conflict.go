@@ -0,0 +1,217 @@
+package keydb
+
+import (
+	"sort"
+)
+
+// Isolation controls how concurrent write transactions on the same table are checked when they commit
+type Isolation int32
+
+const (
+	// NoIsolation never checks, if two transactions write the same key the last to commit wins
+	NoIsolation Isolation = iota
+	// SnapshotIsolation fails a commit with a ConflictError if another transaction wrote one of the same keys, and
+	// committed after this transaction began
+	SnapshotIsolation
+	// Serializable additionally fails a commit if another transaction that committed after this transaction began
+	// wrote a key this transaction read with Get, or a key in the range of a Lookup
+	Serializable
+)
+
+// the keys written by a committed transaction, in order, and the ranges it removed
+type committedWrites struct {
+	seq    uint64
+	keys   [][]byte
+	ranges []keyRange
+}
+
+// the keys read by a transaction, recorded when the table is Serializable
+type readSet struct {
+	keys   [][]byte
+	ranges []keyRange
+}
+
+type keyRange struct {
+	lower, upper []byte // nil if unbounded
+}
+
+func (rs *readSet) addKey(key []byte) {
+	keycopy := make([]byte, len(key))
+	copy(keycopy, key)
+	rs.keys = append(rs.keys, keycopy)
+}
+
+func (rs *readSet) addRange(lower, upper []byte) {
+	r := keyRange{}
+	if lower != nil {
+		r.lower = append([]byte{}, lower...)
+	}
+	if upper != nil {
+		r.upper = append([]byte{}, upper...)
+	}
+	rs.ranges = append(rs.ranges, r)
+}
+
+// returns true if the key is in the sorted keys
+func containsKey(cmp Comparator, keys [][]byte, key []byte) bool {
+	i := sort.Search(len(keys), func(i int) bool {
+		return !lessKeys(cmp, keys[i], key)
+	})
+	return i < len(keys) && equalKeys(cmp, keys[i], key)
+}
+
+// returns the first of the sorted keys in the range, or nil
+func keyInRange(cmp Comparator, keys [][]byte, r keyRange) []byte {
+	i := 0
+	if r.lower != nil {
+		i = sort.Search(len(keys), func(i int) bool {
+			return !lessKeys(cmp, keys[i], r.lower)
+		})
+	}
+	if i == len(keys) {
+		return nil
+	}
+	if r.upper != nil && lessKeys(cmp, r.upper, keys[i]) {
+		return nil
+	}
+	return keys[i]
+}
+
+// returns true if the ranges overlap, the bounds are treated as inclusive
+func rangesOverlap(cmp Comparator, a, b keyRange) bool {
+	if a.upper != nil && b.lower != nil && lessKeys(cmp, a.upper, b.lower) {
+		return false
+	}
+	if b.upper != nil && a.lower != nil && lessKeys(cmp, b.upper, a.lower) {
+		return false
+	}
+	return true
+}
+
+// returns the keys written by the transaction, in order, and the ranges it removed
+func (tx *Transaction) writeSet() (committedWrites, error) {
+	var writes committedWrites
+	for _, r := range tx.memory.RangeTombstones() {
+		writes.ranges = append(writes.ranges, keyRange{lower: r.Lower, upper: r.Upper})
+	}
+	itr, err := tx.memory.Lookup(nil, nil)
+	if err != nil {
+		return writes, err
+	}
+	for {
+		key, _, err := itr.Next()
+		if err == EndOfIterator {
+			return writes, nil
+		}
+		if err != nil {
+			return writes, err
+		}
+		writes.keys = append(writes.keys, key)
+	}
+}
+
+// returns a *ConflictError if the transaction conflicts with a transaction that committed after it began, otherwise
+// the writes of the transaction. a removed range conflicts with every write in the range. the table must be locked
+func (it *internalTable) checkCommit(tx *Transaction, isolation Isolation) (committedWrites, error) {
+	if isolation == NoIsolation {
+		return committedWrites{}, nil
+	}
+
+	writes, err := tx.writeSet()
+	if err != nil {
+		return writes, err
+	}
+	cmp := it.options.comparator
+
+	conflict := func(key []byte) (committedWrites, error) {
+		return writes, &ConflictError{Table: it.name, Key: key}
+	}
+
+	for _, c := range it.commits {
+		if c.seq <= tx.startSeq {
+			continue
+		}
+		for _, key := range writes.keys {
+			if containsKey(cmp, c.keys, key) {
+				return conflict(key)
+			}
+		}
+		for _, r := range c.ranges {
+			if key := keyInRange(cmp, writes.keys, r); key != nil {
+				return conflict(key)
+			}
+		}
+		for _, r := range writes.ranges {
+			if key := keyInRange(cmp, c.keys, r); key != nil {
+				return conflict(key)
+			}
+			for _, other := range c.ranges {
+				if rangesOverlap(cmp, r, other) {
+					return conflict(r.lower)
+				}
+			}
+		}
+		if isolation < Serializable || tx.reads == nil {
+			continue
+		}
+		for _, key := range tx.reads.keys {
+			if containsKey(cmp, c.keys, key) || rangesContainKey(cmp, c.ranges, key) {
+				return conflict(key)
+			}
+		}
+		for _, r := range tx.reads.ranges {
+			if key := keyInRange(cmp, c.keys, r); key != nil {
+				return conflict(key)
+			}
+			for _, other := range c.ranges {
+				if rangesOverlap(cmp, r, other) {
+					return conflict(r.lower)
+				}
+			}
+		}
+	}
+	return writes, nil
+}
+
+// returns true if the key is in any of the ranges
+func rangesContainKey(cmp Comparator, ranges []keyRange, key []byte) bool {
+	for _, r := range ranges {
+		if keyInRange(cmp, [][]byte{key}, r) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// records the writes of a committed transaction, so the open transactions can be checked against them. the table
+// must be locked
+func (it *internalTable) recordCommit(tx *Transaction, writes committedWrites, isolation Isolation) {
+	it.commitSeq++
+	if isolation != NoIsolation && (len(writes.keys) > 0 || len(writes.ranges) > 0) && len(it.active) > 1 {
+		writes.seq = it.commitSeq
+		it.commits = append(it.commits, writes)
+	}
+	it.pruneCommits(tx.id)
+	delete(it.active, tx.id)
+}
+
+// called when a transaction is rolled back or fails to commit. the table must be locked
+func (it *internalTable) abortCommit(tx *Transaction) {
+	it.pruneCommits(tx.id)
+	delete(it.active, tx.id)
+}
+
+// discards the commits that no open transaction, other than the one completing, began before
+func (it *internalTable) pruneCommits(completing uint64) {
+	oldest := it.commitSeq
+	for id, seq := range it.active {
+		if id != completing && seq < oldest {
+			oldest = seq
+		}
+	}
+	i := 0
+	for i < len(it.commits) && it.commits[i].seq <= oldest {
+		i++
+	}
+	it.commits = it.commits[i:]
+}
@@ -1,7 +1,7 @@
 package keydb
 
 import (
-	"bytes"
+	"fmt"
 	"github.com/nightlyone/lockfile"
 	"io/ioutil"
 	"os"
@@ -22,6 +22,14 @@ type Database struct {
 	wg           sync.WaitGroup
 	nextSegID    uint64 // 单调递增的segmentId
 	lockfile     lockfile.Lockfile
+	options      Options
+	wal          *writeAheadLog
+	manifest     *manifest
+	recovery     []string // changes made when opening the database to repair the effects of a crash
+	sync         int32    // the Durability, accessed atomically
+	quiescing    int32    // the number of Checkpoint and Backup calls waiting for open write transactions, accessed atomically
+	filterStats  filterStats
+	cache        *blockCache
 
 	// if non-nil an asynchronous error has occurred, and the database cannot be used
 	err error
@@ -32,36 +40,73 @@ type internalTable struct {
 	segments     []segment
 	transactions int
 	name         string
+	options      tableOptions
+	// the conflict detection state, see Isolation
+	commitSeq uint64            // the number of commits
+	commits   []committedWrites // the commits an open transaction may conflict with
+	active    map[uint64]uint64 // the commitSeq when each open write transaction began
+	// held by the merger while merging the table, and by DropTable and RenameTable
+	merge   sync.Mutex
+	dropped bool
 }
 
-// LookupIterator iterator interface for table scanning. all iterators should be read until completion
+// LookupIterator iterator interface for table scanning. all iterators should be read until completion, see Iterator
+// for an iterator that can be positioned and closed
 type LookupIterator interface {
 	// returns EndOfIterator when complete, if err is nil, then key and value are valid
 	Next() (key []byte, value []byte, err error)
 	// returns the next non-deleted key in the index
 	peekKey() ([]byte, error)
+	// returns true if the value last returned by Next is a list of merge operands, see MergeOperator
+	operands() bool
+	// returns the time the value last returned by Next expires in unix nanoseconds, 0 if it does not expire
+	expiry() int64
 }
 
+// Durability controls when the database forces writes to stable storage. The write-ahead log protects commits
+// against a process crash at every level, the levels differ in what survives an OS or hardware failure
+type Durability int32
+
+const (
+	// SyncNone never syncs, an OS failure can lose recent commits or corrupt the segment files
+	SyncNone Durability = iota
+	// SyncOnSegmentWrite syncs the key and data files and their directory whenever a segment is written or merged,
+	// so the segments on disk are always consistent, but commits not yet written to a segment can be lost
+	SyncOnSegmentWrite
+	// SyncOnCommit additionally syncs the write-ahead log before Commit returns, so every commit survives an OS failure
+	SyncOnCommit
+)
+
 var dblock sync.RWMutex
 
 // Open a database. The database can only be opened by a single process, but the *Database
 // reference can be shared across Go routines. The path is a directory name.
 // if createIfNeeded is true, them if the db doesn't exist it will be created
-// Additional tables can be added on subsequent opens, but there is no current way to delete a table,
-// except for deleting the table related files from the directory
+// Additional tables can be added on subsequent opens, and tables are removed with DropTable
 func Open(path string, createIfNeeded bool) (*Database, error) {
+	return OpenWithOptions(path, Options{CreateIfNeeded: createIfNeeded})
+}
+
+// OpenWithOptions opens a database like Open, with control of the engine settings. The options are validated,
+// and only apply until the database is closed
+func OpenWithOptions(path string, options Options) (*Database, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
 	dblock.Lock()
 	defer dblock.Unlock()
 
-	db, err := open(path)
-	if err == NoDatabaseFound && createIfNeeded == true {
+	db, err := open(path, options)
+	if err == NoDatabaseFound && options.CreateIfNeeded == true {
 		// 初始化数据库文件
-		return create(path)
+		return create(path, options)
 	}
 	return db, err
 }
 
-func open(path string) (*Database, error) {
+func open(path string, options Options) (*Database, error) {
 
 	path = filepath.Clean(path)
 
@@ -86,6 +131,32 @@ func open(path string) (*Database, error) {
 
 	db := &Database{path: path, open: true}
 	db.lockfile = lf
+	db.options = options
+	db.sync = int32(options.Durability)
+	db.cache = newBlockCache(options.BlockCacheSize)
+
+	db.recovery, err = recoverSegmentFiles(path)
+	if err != nil {
+		lf.Unlock()
+		return nil, err
+	}
+
+	manifest, report, err := openManifest(path)
+	db.recovery = append(db.recovery, report...)
+	if err != nil {
+		lf.Unlock()
+		return nil, err
+	}
+	db.manifest = manifest
+	db.nextSegID = manifest.maxSegmentID()
+
+	err = recoverWAL(db)
+	if err != nil {
+		manifest.close()
+		lf.Unlock()
+		return nil, err
+	}
+
 	// 创建一个空的事务容器，所有事务都被保存在这里
 	db.transactions = make(map[uint64]*Transaction)
 	// 创建一个空的数据快照，所有随事务创建的快照都保存在这里
@@ -98,7 +169,7 @@ func open(path string) (*Database, error) {
 	return db, nil
 }
 
-func create(path string) (*Database, error) {
+func create(path string, options Options) (*Database, error) {
 	path = filepath.Clean(path)
 
 	err := os.MkdirAll(path, os.ModePerm)
@@ -106,7 +177,7 @@ func create(path string) (*Database, error) {
 		return nil, err
 	}
 
-	return open(path)
+	return open(path, options)
 }
 
 // Remove the database, deleting all files. the caller must be able to
@@ -157,13 +228,14 @@ func IsValidDatabase(path string) error {
 
 	for _, f := range infos {
 		// lockfile是文件锁，忽略
-		if "lockfile" == f.Name() {
+		switch f.Name() {
+		case "lockfile", walFilename, manifestFilename, manifestFilename + ".tmp":
 			continue
 		}
 		if f.Name() == filepath.Base(path) {
 			continue
 		}
-		if matched, _ := regexp.Match(".*\\.(keys|data)\\..*", []byte(f.Name())); !matched {
+		if matched, _ := regexp.Match(".*\\.(keys|data|bloom)\\..*", []byte(f.Name())); !matched {
 			return NotValidDatabase
 		}
 	}
@@ -171,7 +243,7 @@ func IsValidDatabase(path string) error {
 }
 
 // Close the database. any memory segments are persisted to disk.
-// The resulting segments are merged until the default maxSegments is reached
+// The resulting segments are merged until the MaxSegments of each table is reached
 func (db *Database) Close() error {
 	dblock.Lock()
 	defer dblock.Unlock()
@@ -188,7 +260,7 @@ func (db *Database) Close() error {
 
 	db.wg.Wait()
 
-	err := mergeDiskSegments0(db, maxSegments)
+	err := mergeDiskSegments0(db, 0)
 
 	for _, table := range db.tables {
 		for _, segment := range table.segments {
@@ -196,6 +268,8 @@ func (db *Database) Close() error {
 		}
 	}
 
+	db.wal.close()
+	db.manifest.close()
 	db.lockfile.Unlock()
 	db.open = false
 
@@ -233,19 +307,87 @@ func (db *Database) CloseWithMerge(segmentCount int) error {
 		}
 	}
 
+	db.wal.close()
+	db.manifest.close()
 	db.lockfile.Unlock()
 	db.open = false
 
 	return nil
 }
 
+// RecoveryReport describes the repairs made when the database was opened, such as removing temporary files or
+// completing merges interrupted by a crash, and rebuilding committed segments from the write-ahead log. it is empty
+// if the database was closed cleanly
+func (db *Database) RecoveryReport() []string {
+	return db.recovery
+}
+
+// SetDurability sets when the database syncs writes to disk, overriding Options.Durability. the default is SyncNone
+func (db *Database) SetDurability(durability Durability) {
+	atomic.StoreInt32(&db.sync, int32(durability))
+}
+
+func (db *Database) durability() Durability {
+	return Durability(atomic.LoadInt32(&db.sync))
+}
+
 func (db *Database) nextSegmentID() uint64 {
 	return atomic.AddUint64(&db.nextSegID, 1)
 }
 
-func less(a []byte, b []byte) bool {
-	return bytes.Compare(a, b) < 0
-}
-func equal(a []byte, b []byte) bool {
-	return bytes.Equal(a, b)
+// opens the write-ahead log and writes any committed segments that were not written to disk before
+// the database was last closed
+func recoverWAL(db *Database) error {
+	wal, records, err := openWAL(db.path, func(table string) Comparator {
+		return db.options.forTable(table).comparator
+	})
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		// the segment was added to the manifest, but the record that it was written is missing from the log
+		if db.manifest.holdsSegment(rec.table, rec.id) {
+			continue
+		}
+		// the segment must be written in the order of the comparator of the table
+		if err := db.checkComparator(rec.table); err != nil {
+			wal.close()
+			return err
+		}
+		keyFilename, dataFilename := segmentFilenames(db.path, rec.table, rec.id)
+		itr, err := rec.seg.Lookup(nil, nil)
+		if err != nil {
+			wal.close()
+			return err
+		}
+		// the log is truncated once recovery completes, so the recovered segments are always synced
+		options := db.segmentOptions(rec.table)
+		options.sync = true
+		ds, err := writeAndLoadSegment(keyFilename, dataFilename, itr, rec.seg.RangeTombstones(), options)
+		if err == errEmptySegment {
+			continue
+		}
+		if err != nil {
+			wal.close()
+			return err
+		}
+		err = db.manifest.apply([]manifestChange{{op: addSegment, table: rec.table, info: newSegmentInfo(ds.(*diskSegment))}}, true)
+		ds.Close()
+		if err != nil {
+			wal.close()
+			return err
+		}
+		db.recovery = append(db.recovery, fmt.Sprint("rebuilt segment ", rec.id, " of table ", rec.table, " from the write-ahead log"))
+		if rec.id > db.nextSegID {
+			db.nextSegID = rec.id
+		}
+	}
+	if len(records) > 0 {
+		if err := wal.truncate(); err != nil {
+			wal.close()
+			return err
+		}
+	}
+	db.wal = wal
+	return nil
 }
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -434,7 +437,7 @@ func TestRemovedKeys(t *testing.T) {
 	err = db.CloseWithMerge(1)
 }
 
-func TestSegment(t *testing.T)  {
+func TestSegment(t *testing.T) {
 	keydb.Remove("test/mydb")
 	db, err := keydb.Open("test/mydb", true)
 	if err != nil {
@@ -465,4 +468,1302 @@ func TestMerge(t *testing.T) {
 	if err = db.CloseWithMerge(1); err != nil {
 		panic(err)
 	}
-}
\ No newline at end of file
+}
+func TestOpenWithOptions(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	_, err := keydb.OpenWithOptions("test/mydb", keydb.Options{CreateIfNeeded: true, KeyBlockSize: 100})
+	if err == nil {
+		t.Fatal("should not of been able to open with an invalid block size")
+	}
+	_, err = keydb.OpenWithOptions("test/mydb", keydb.Options{CreateIfNeeded: true, Tables: map[string]keydb.TableOptions{"main": {MaxSegments: 10, WriteStallSegments: 5}}})
+	if err == nil {
+		t.Fatal("should not of been able to open with an invalid table write stall")
+	}
+
+	options := keydb.Options{
+		CreateIfNeeded: true,
+		KeyBlockSize:   8192,
+		MaxSegments:    2,
+		MergeInterval:  10 * time.Millisecond,
+		Tables:         map[string]keydb.TableOptions{"other": {KeyBlockSize: 16384}}}
+
+	db, err := keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 20; i++ {
+		for _, table := range []string{"main", "other"} {
+			tx, err := db.BeginTX(table)
+			if err != nil {
+				t.Fatal("unable to create transaction", err)
+			}
+			for j := 0; j < 100; j++ {
+				tx.Put([]byte(fmt.Sprint("mykey", i*100+j)), []byte(fmt.Sprint("myvalue", i*100+j)))
+			}
+			if err = tx.CommitSync(); err != nil {
+				t.Fatal("unable to commit", err)
+			}
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	if count := countFiles("test/mydb"); count > 8 {
+		t.Fatal("there should be at most MaxSegments*2 files per table, count is ", count)
+	}
+
+	// segments are read with the block size they were written with
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	for _, table := range []string{"main", "other"} {
+		tx, err := db.BeginTX(table)
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		value, err := tx.Get([]byte("mykey1234"))
+		if err != nil || string(value) != "myvalue1234" {
+			t.Fatal("unable to get by key", err)
+		}
+		itr, err := tx.Lookup(nil, nil)
+		count := 0
+		for {
+			_, _, err = itr.Next()
+			if err != nil {
+				break
+			}
+			count++
+		}
+		if count != 2000 {
+			t.Fatal("incorrect count", count)
+		}
+		tx.Commit()
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestFilterStats(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.OpenWithOptions("test/mydb", keydb.Options{CreateIfNeeded: true, MaxSegments: 100})
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 10; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		for j := 0; j < 100; j++ {
+			tx.Put([]byte(fmt.Sprint("mykey", i*100+j)), []byte(fmt.Sprint("myvalue", i*100+j)))
+		}
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// the filters are loaded with the segments
+	db, err = keydb.OpenWithOptions("test/mydb", keydb.Options{MaxSegments: 100})
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	value, err := tx.Get([]byte("mykey50"))
+	if err != nil || string(value) != "myvalue50" {
+		t.Fatal("unable to get by key", err)
+	}
+	_, err = tx.Get([]byte("notakey"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("key should not be found", err)
+	}
+	tx.Commit()
+
+	stats := db.FilterStats()
+	if stats.Checks < 20 || stats.Skipped < 15 || stats.Skipped+stats.FalsePositives+1 != stats.Checks {
+		t.Fatal("incorrect filter stats", stats)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	keydb.Remove("test/mydb")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 1000; i++ {
+		tx.Put([]byte(fmt.Sprintf("mykey%04d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Remove([]byte("mykey0501"))
+
+	itr, err := tx.NewIterator([]byte("mykey0100"), []byte("mykey0899"))
+	if err != nil {
+		t.Fatal("unable to create iterator", err)
+	}
+	if itr.Valid() {
+		t.Fatal("iterator should not be positioned")
+	}
+	if !itr.First() || string(itr.Key()) != "mykey0100" {
+		t.Fatal("incorrect first key", string(itr.Key()))
+	}
+	if !itr.Last() || string(itr.Key()) != "mykey0899" {
+		t.Fatal("incorrect last key", string(itr.Key()))
+	}
+	if itr.Next() || itr.Valid() {
+		t.Fatal("iterator should be past the end of the range")
+	}
+	if !itr.Seek([]byte("mykey0500")) || string(itr.Value()) != "myvalue500" {
+		t.Fatal("incorrect seek", string(itr.Key()))
+	}
+	if !itr.Next() || string(itr.Key()) != "mykey0502" {
+		t.Fatal("removed key should be skipped", string(itr.Key()))
+	}
+	if !itr.Prev() || string(itr.Key()) != "mykey0500" {
+		t.Fatal("incorrect prev", string(itr.Key()))
+	}
+	if !itr.Prev() || string(itr.Key()) != "mykey0499" {
+		t.Fatal("incorrect prev", string(itr.Key()))
+	}
+	if !itr.Next() || string(itr.Key()) != "mykey0500" {
+		t.Fatal("incorrect next", string(itr.Key()))
+	}
+	if !itr.Seek([]byte("a")) || string(itr.Key()) != "mykey0100" {
+		t.Fatal("seek before the range should be at the first key", string(itr.Key()))
+	}
+	if itr.Seek([]byte("z")) {
+		t.Fatal("seek after the range should be invalid")
+	}
+	if !itr.SeekForPrev([]byte("mykey0501")) || string(itr.Key()) != "mykey0500" {
+		t.Fatal("incorrect seek for prev", string(itr.Key()))
+	}
+	count := 0
+	for ok := itr.First(); ok; ok = itr.Next() {
+		count++
+	}
+	if count != 799 || itr.Err() != nil {
+		t.Fatal("incorrect count", count, itr.Err())
+	}
+	if err = itr.Close(); err != nil {
+		t.Fatal("unable to close iterator", err)
+	}
+	if itr.First() {
+		t.Fatal("closed iterator should not be positioned")
+	}
+	tx.Rollback()
+
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestLookupPrefix(t *testing.T) {
+	keydb.Remove("test/mydb")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for _, key := range []string{"AAP", "AAPL", "AAPL|1", "AAPL|2", "AAPL|3", "AAPM|1", "AAPL\xff"} {
+		tx.Put([]byte(key), []byte(key))
+	}
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	// the keys are in both a disk segment and the transaction
+	tx.Put([]byte("AAPL|4"), []byte("AAPL|4"))
+
+	expect := func(itr keydb.LookupIterator, err error, keys ...string) {
+		if err != nil {
+			t.Fatal("unable to lookup", err)
+		}
+		var found []string
+		for {
+			key, _, err := itr.Next()
+			if err != nil {
+				break
+			}
+			found = append(found, string(key))
+		}
+		if fmt.Sprint(found) != fmt.Sprint(keys) {
+			t.Fatal("incorrect keys", found, "expected", keys)
+		}
+	}
+
+	itr, err := tx.LookupPrefix([]byte("AAPL|"))
+	expect(itr, err, "AAPL|1", "AAPL|2", "AAPL|3", "AAPL|4")
+	itr, err = tx.LookupRange(keydb.Range{Lower: []byte("AAPL|1"), Upper: []byte("AAPL|4"), ExcludeLower: true, ExcludeUpper: true})
+	expect(itr, err, "AAPL|2", "AAPL|3")
+	itr, err = tx.LookupRangeReverse(keydb.Range{Lower: []byte("AAPL"), Upper: []byte("AAPL|3"), ExcludeLower: true})
+	expect(itr, err, "AAPL|3", "AAPL|2", "AAPL|1")
+	itr, err = tx.LookupPrefix([]byte("AAPL\xff"))
+	expect(itr, err, "AAPL\xff")
+
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+// orders the keys in descending order
+type reverseComparator struct{}
+
+func (reverseComparator) Name() string {
+	return "test.ReverseComparator"
+}
+
+func (reverseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func TestComparator(t *testing.T) {
+	keydb.Remove("test/mydb")
+	options := keydb.Options{CreateIfNeeded: true, Tables: map[string]keydb.TableOptions{"main": {Comparator: reverseComparator{}}}}
+	db, err := keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	// several segments with enough keys for many key blocks, so the segments are searched and merged
+	for i := 0; i < 3; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		for j := i; j < 1000; j += 3 {
+			key := []byte(fmt.Sprintf("mykey%7d", j))
+			tx.Put(key, key)
+		}
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte(fmt.Sprintf("mykey%7d", 500)), []byte("updated"))
+	value, err := tx.Get([]byte(fmt.Sprintf("mykey%7d", 777)))
+	if err != nil || string(value) != fmt.Sprintf("mykey%7d", 777) {
+		t.Fatal("incorrect value", string(value), err)
+	}
+
+	// the lower bound is the greatest key in the order of the comparator
+	itr, err := tx.Lookup([]byte(fmt.Sprintf("mykey%7d", 510)), []byte(fmt.Sprintf("mykey%7d", 490)))
+	if err != nil {
+		t.Fatal("unable to lookup", err)
+	}
+	count := 0
+	for {
+		key, value, err := itr.Next()
+		if err != nil {
+			break
+		}
+		if string(key) != fmt.Sprintf("mykey%7d", 510-count) {
+			t.Fatal("incorrect key", string(key), "at", count)
+		}
+		if count == 10 && string(value) != "updated" {
+			t.Fatal("incorrect value", string(value))
+		}
+		count++
+	}
+	if count != 21 {
+		t.Fatal("incorrect count", count)
+	}
+	// the keys with a prefix are not contiguous in the order of the comparator
+	if _, err = tx.LookupPrefix([]byte("mykey")); err != keydb.PrefixRequiresBytewise {
+		t.Fatal("expected PrefixRequiresBytewise", err)
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// the table was created with a different comparator, only the table cannot be used
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if _, err = db.BeginReadTX("main"); err == nil {
+		t.Fatal("expected a ComparatorError")
+	}
+	if e, ok := err.(*keydb.ComparatorError); !ok || e.Table != "main" || e.Expected != (reverseComparator{}).Name() {
+		t.Fatal("expected a ComparatorError", err)
+	}
+	tx, err = db.BeginTX("other")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey"), []byte("myvalue"))
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	// the segment files of the table are still copied
+	os.RemoveAll("test/checkpoint")
+	if err = db.Checkpoint("test/checkpoint"); err != nil {
+		t.Fatal("unable to checkpoint", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	report, err := keydb.Check("test/mydb", keydb.Options{}, false)
+	if err != nil {
+		t.Fatal("unable to check database", err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Table != "main" || report.Keys["other"] != 1 {
+		t.Fatal("incorrect report", report.Problems, report.Keys)
+	}
+
+	db, err = keydb.OpenWithOptions("test/checkpoint", options)
+	if err != nil {
+		t.Fatal("unable to open checkpoint", err)
+	}
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte(fmt.Sprintf("mykey%7d", 999))); err != nil || string(value) != fmt.Sprintf("mykey%7d", 999) {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close checkpoint", err)
+	}
+	os.RemoveAll("test/checkpoint")
+}
+
+func TestDropTable(t *testing.T) {
+	keydb.Remove("test/mydb")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for _, table := range []string{"a", "b", "c"} {
+		tx, err := db.BeginTX(table)
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte("mykey"), []byte(table))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	tables, err := db.ListTables()
+	if err != nil || fmt.Sprint(tables) != "[a b c]" {
+		t.Fatal("incorrect tables", tables, err)
+	}
+
+	// a read only transaction keeps reading the dropped table
+	rtx, err := db.BeginReadTX("a")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if err = db.DropTable("a"); err != nil {
+		t.Fatal("unable to drop table", err)
+	}
+	if value, err := rtx.Get([]byte("mykey")); err != nil || string(value) != "a" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	rtx.Commit()
+
+	if err = db.RenameTable("b", "d"); err != nil {
+		t.Fatal("unable to rename table", err)
+	}
+	if err = db.RenameTable("c", "d"); err != keydb.TableExists {
+		t.Fatal("expected TableExists", err)
+	}
+	if err = db.DropTable("b"); err != keydb.TableNotFound {
+		t.Fatal("expected TableNotFound", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tables, err = db.ListTables()
+	if err != nil || fmt.Sprint(tables) != "[c d]" {
+		t.Fatal("incorrect tables", tables, err)
+	}
+	tx, err := db.BeginTX("d")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte("mykey")); err != nil || string(value) != "b" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+	tx, err = db.BeginTX("a")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if _, err := tx.Get([]byte("mykey")); err != keydb.KeyNotFound {
+		t.Fatal("the table was not dropped", err)
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	files, _ := ioutil.ReadDir("test/mydb")
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "a.") || strings.HasPrefix(f.Name(), "b.") {
+			t.Fatal("segment file was not removed", f.Name())
+		}
+	}
+}
+
+func TestRemoveRange(t *testing.T) {
+	keydb.Remove("test/mydb")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 1000; i++ {
+		tx.Put([]byte(fmt.Sprintf("mykey%04d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if err = tx.RemoveRange([]byte("mykey0100"), []byte("mykey0199")); err != nil {
+		t.Fatal("unable to remove range", err)
+	}
+	tx.Put([]byte("mykey0150"), []byte("updated"))
+	if err = tx.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	check := func() {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		if _, err := tx.Get([]byte("mykey0120")); err != keydb.KeyNotFound {
+			t.Fatal("key should be removed", err)
+		}
+		if value, err := tx.Get([]byte("mykey0150")); err != nil || string(value) != "updated" {
+			t.Fatal("incorrect value", string(value), err)
+		}
+		if value, err := tx.Get([]byte("mykey0200")); err != nil || string(value) != "myvalue200" {
+			t.Fatal("incorrect value", string(value), err)
+		}
+		itr, err := tx.Lookup(nil, nil)
+		if err != nil {
+			t.Fatal("unable to lookup", err)
+		}
+		count := 0
+		for {
+			_, _, err := itr.Next()
+			if err != nil {
+				break
+			}
+			count++
+		}
+		if count != 901 {
+			t.Fatal("incorrect count", count)
+		}
+		tx.Rollback()
+	}
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+// counterOperator adds the operands to the value, as decimal integers
+type counterOperator struct{}
+
+func (counterOperator) Name() string {
+	return "test.CounterOperator"
+}
+
+func (counterOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int
+	if existing != nil {
+		n, err := strconv.Atoi(string(existing))
+		if err != nil {
+			return nil, err
+		}
+		sum = n
+	}
+	for _, operand := range operands {
+		n, err := strconv.Atoi(string(operand))
+		if err != nil {
+			return nil, err
+		}
+		sum += n
+	}
+	return []byte(strconv.Itoa(sum)), nil
+}
+
+func TestMergeOperator(t *testing.T) {
+	keydb.Remove("test/mydb")
+	options := keydb.Options{CreateIfNeeded: true, Tables: map[string]keydb.TableOptions{"counters": {MergeOperator: counterOperator{}}}}
+	db, err := keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if err = tx.Merge([]byte("mykey"), []byte("1")); err != keydb.NoMergeOperator {
+		t.Fatal("merge should fail without an operator", err)
+	}
+	tx.Rollback()
+
+	// the operands of each commit are in a separate segment
+	for i := 0; i < 5; i++ {
+		tx, err := db.BeginTX("counters")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		if i == 0 {
+			tx.Put([]byte("mykey2"), []byte("100"))
+		}
+		tx.Merge([]byte("mykey1"), []byte("1"))
+		tx.Merge([]byte("mykey1"), []byte("2"))
+		tx.Merge([]byte("mykey2"), []byte("-1"))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	tx, err = db.BeginTX("counters")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	// applied to the removed value immediately
+	tx.Put([]byte("mykey3"), []byte("5"))
+	tx.Remove([]byte("mykey3"))
+	tx.Merge([]byte("mykey3"), []byte("7"))
+	if err = tx.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	check := func() {
+		tx, err := db.BeginReadTX("counters")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		defer tx.Rollback()
+		expected := map[string]string{"mykey1": "15", "mykey2": "95", "mykey3": "7"}
+		for key, value := range expected {
+			if v, err := tx.Get([]byte(key)); err != nil || string(v) != value {
+				t.Fatal("incorrect value for", key, string(v), err)
+			}
+		}
+		itr, err := tx.Lookup(nil, nil)
+		if err != nil {
+			t.Fatal("unable to lookup", err)
+		}
+		count := 0
+		for {
+			key, value, err := itr.Next()
+			if err != nil {
+				break
+			}
+			if expected[string(key)] != string(value) {
+				t.Fatal("incorrect value for", string(key), string(value))
+			}
+			count++
+		}
+		if count != 3 {
+			t.Fatal("incorrect count", count)
+		}
+	}
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	check()
+	if err = db.CloseWithMerge(1); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestPutWithTTL(t *testing.T) {
+	keydb.Remove("test/mydb")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey1"), []byte("myvalue1"))
+	if err = tx.PutWithTTL([]byte("mykey2"), []byte("myvalue2"), 0); err != keydb.InvalidTTL {
+		t.Fatal("ttl should be positive", err)
+	}
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.PutWithTTL([]byte("mykey1"), []byte("expires"), 500*time.Millisecond)
+	tx.PutWithTTL([]byte("mykey2"), []byte("myvalue2"), time.Hour)
+	tx.Put([]byte("mykey3"), []byte("myvalue3"))
+	// the expiry overflows, so the key never expires
+	if err = tx.PutWithTTL([]byte("mykey4"), []byte("myvalue4"), time.Duration(math.MaxInt64)); err != nil {
+		t.Fatal("unable to put", err)
+	}
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte("mykey1")); err != nil || string(value) != "expires" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+	time.Sleep(time.Second)
+
+	check := func() {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		defer tx.Rollback()
+		// the expired value does not reveal the older value
+		if _, err := tx.Get([]byte("mykey1")); err != keydb.KeyNotFound {
+			t.Fatal("expired key should not be found", err)
+		}
+		if value, err := tx.Get([]byte("mykey2")); err != nil || string(value) != "myvalue2" {
+			t.Fatal("incorrect value", string(value), err)
+		}
+		if value, err := tx.Get([]byte("mykey4")); err != nil || string(value) != "myvalue4" {
+			t.Fatal("incorrect value", string(value), err)
+		}
+		itr, err := tx.Lookup(nil, nil)
+		if err != nil {
+			t.Fatal("unable to lookup", err)
+		}
+		count := 0
+		for {
+			key, _, err := itr.Next()
+			if err != nil {
+				break
+			}
+			if string(key) == "mykey1" {
+				t.Fatal("expired key should not be returned")
+			}
+			count++
+		}
+		if count != 3 {
+			t.Fatal("incorrect count", count)
+		}
+	}
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	check()
+	if err = db.CloseWithMerge(1); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	keydb.Remove("test/mydb")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	// binary keys and values, which are not valid text
+	expected := map[string]map[string]string{"main": {}, "ticks": {}}
+	for table, entries := range expected {
+		tx, err := db.BeginTX(table)
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		for i := 0; i < 1000; i++ {
+			key := string([]byte{0, byte(i >> 8), byte(i), '<', 0xff})
+			value := fmt.Sprint("&value", i, "\x00\xfe")
+			if i == 0 {
+				value = ""
+			}
+			tx.Put([]byte(key), []byte(value))
+			entries[key] = value
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	check := func(options keydb.DumpOptions) {
+		var buf bytes.Buffer
+		if err := db.Dump(&buf, options); err != nil {
+			t.Fatal("unable to dump", options, err)
+		}
+		dump := buf.Bytes()
+
+		keydb.Remove("test/mydb2")
+		db2, err := keydb.Open("test/mydb2", true)
+		if err != nil {
+			t.Fatal("unable to create database", err)
+		}
+		defer db2.Close()
+		if err := db2.Load(bytes.NewReader(dump), keydb.DumpOptions{}); err != nil {
+			t.Fatal("unable to load", options, err)
+		}
+		for table, entries := range expected {
+			tx, err := db2.BeginReadTX(table)
+			if err != nil {
+				t.Fatal("unable to create transaction", err)
+			}
+			count := 0
+			itr, _ := tx.Lookup(nil, nil)
+			for {
+				key, value, err := itr.Next()
+				if err != nil {
+					break
+				}
+				if entries[string(key)] != string(value) {
+					t.Fatal("incorrect value", options, table, key, value)
+				}
+				count++
+			}
+			tx.Rollback()
+			if count != len(entries) {
+				t.Fatal("incorrect count", options, table, count)
+			}
+		}
+
+		// a truncated or modified dump is detected
+		if err := db2.Load(bytes.NewReader(dump[:len(dump)-10]), keydb.DumpOptions{}); err == nil {
+			t.Fatal("truncated dump should not load", options)
+		}
+		modified := append([]byte(nil), dump...)
+		if options.Format == keydb.DumpBinary {
+			modified[len(modified)/2] ^= 1
+		} else {
+			modified = bytes.Replace(modified, []byte("<count>1000</count>"), []byte("<count>999</count>"), 1)
+		}
+		if err := db2.Load(bytes.NewReader(modified), keydb.DumpOptions{}); err == nil {
+			t.Fatal("modified dump should not load", options)
+		}
+	}
+	check(keydb.DumpOptions{})
+	check(keydb.DumpOptions{Format: keydb.DumpXML, Encoding: "hex"})
+	check(keydb.DumpOptions{Format: keydb.DumpBinary})
+
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// the format of the older dbdump
+	legacy := "<db path=\"test/mydb\">\n\t<tabledata name=\"main\">\n\t\t<entry><key>my&lt;key</key> <value>myvalue</value></entry>\n\t</tabledata>\n</db>\n"
+	keydb.Remove("test/mydb2")
+	db2, err := keydb.Open("test/mydb2", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	if err = db2.Load(strings.NewReader(legacy), keydb.DumpOptions{}); err != nil {
+		t.Fatal("unable to load", err)
+	}
+	tx, err := db2.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte("my<key")); err != nil || string(value) != "myvalue" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+	if err = db2.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestDumpText(t *testing.T) {
+	keydb.Remove("test/mydb")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for _, table := range []string{"main", "other"} {
+		tx, err := db.BeginTX(table)
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		for i := 0; i < 100; i++ {
+			tx.Put([]byte(fmt.Sprintf("mykey%03d", i)), []byte(fmt.Sprint("my \"value\",\n", i)))
+		}
+		if err = tx.Commit(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	defer db.Close()
+
+	for _, format := range []keydb.DumpFormat{keydb.DumpJSONL, keydb.DumpCSV} {
+		for _, encoding := range []string{"utf8", "hex", "base64"} {
+			options := keydb.DumpOptions{Format: format, Encoding: encoding, Tables: []string{"other"},
+				Range: keydb.Range{Lower: []byte("mykey010"), Upper: []byte("mykey019")}}
+			var buf bytes.Buffer
+			if err := db.Dump(&buf, options); err != nil {
+				t.Fatal("unable to dump", format, encoding, err)
+			}
+			if encoding == "utf8" && !strings.Contains(buf.String(), "mykey015") {
+				t.Fatal("keys should be text", format, buf.String())
+			}
+
+			keydb.Remove("test/mydb2")
+			db2, err := keydb.Open("test/mydb2", true)
+			if err != nil {
+				t.Fatal("unable to create database", err)
+			}
+			// the load range is applied to the keys of the dump
+			load := keydb.DumpOptions{Format: format, Encoding: encoding, Range: keydb.Range{Lower: []byte("mykey015")}}
+			if err := db2.Load(&buf, load); err != nil {
+				t.Fatal("unable to load", format, encoding, err)
+			}
+			tables, _ := db2.ListTables()
+			if len(tables) != 1 || tables[0] != "other" {
+				t.Fatal("incorrect tables", tables)
+			}
+			tx, err := db2.BeginTX("other")
+			if err != nil {
+				t.Fatal("unable to create transaction", err)
+			}
+			itr, _ := tx.Lookup(nil, nil)
+			count := 0
+			for {
+				key, value, err := itr.Next()
+				if err != nil {
+					break
+				}
+				if string(value) != fmt.Sprint("my \"value\",\n", 15+count) || string(key) != fmt.Sprintf("mykey%03d", 15+count) {
+					t.Fatal("incorrect entry", format, encoding, string(key), string(value))
+				}
+				count++
+			}
+			tx.Rollback()
+			if count != 5 {
+				t.Fatal("incorrect count", format, encoding, count)
+			}
+			db2.Close()
+		}
+	}
+
+	// binary keys cannot be written as text
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte{0xff, 0xfe}, []byte("myvalue"))
+	if err = tx.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	if err = db.Dump(ioutil.Discard, keydb.DumpOptions{Format: keydb.DumpJSONL, Encoding: "utf8"}); err == nil {
+		t.Fatal("invalid utf8 should not be dumped as text")
+	}
+	if err = db.Dump(ioutil.Discard, keydb.DumpOptions{Tables: []string{"missing"}}); err != keydb.TableNotFound {
+		t.Fatal("missing table should not be dumped", err)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	keydb.Remove("test/mydb")
+	os.RemoveAll("test/checkpoint")
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for _, table := range []string{"a", "b"} {
+		for i := 0; i < 10; i++ {
+			tx, err := db.BeginTX(table)
+			if err != nil {
+				t.Fatal("unable to create transaction", err)
+			}
+			tx.Put([]byte("mykey"+strconv.Itoa(i)), []byte(table))
+			// the segments written by Commit are flushed by Checkpoint
+			if err = tx.Commit(); err != nil {
+				t.Fatal("unable to commit", err)
+			}
+		}
+	}
+
+	if err = db.Checkpoint("test/checkpoint"); err != nil {
+		t.Fatal("unable to checkpoint", err)
+	}
+	if err = db.Checkpoint("test/checkpoint"); err == nil {
+		t.Fatal("checkpoint should fail if the directory exists")
+	}
+
+	// the database remains usable, and later commits are not in the checkpoint
+	tx, err := db.BeginTX("a")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey0"), []byte("changed"))
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	cp, err := keydb.Open("test/checkpoint", false)
+	if err != nil {
+		t.Fatal("unable to open checkpoint", err)
+	}
+	tables, err := cp.ListTables()
+	if err != nil || fmt.Sprint(tables) != "[a b]" {
+		t.Fatal("incorrect tables", tables, err)
+	}
+	for _, table := range []string{"a", "b"} {
+		tx, err := cp.BeginTX(table)
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		for i := 0; i < 10; i++ {
+			if value, err := tx.Get([]byte("mykey" + strconv.Itoa(i))); err != nil || string(value) != table {
+				t.Fatal("incorrect value", string(value), err)
+			}
+		}
+		tx.Rollback()
+	}
+	if err = cp.Close(); err != nil {
+		t.Fatal("unable to close checkpoint", err)
+	}
+
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err = db.BeginTX("a")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte("mykey0")); err != nil || string(value) != "changed" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	os.RemoveAll("test/checkpoint")
+}
+
+func TestBackup(t *testing.T) {
+	keydb.Remove("test/mydb")
+	for _, dir := range []string{"test/backup0", "test/backup1", "test/restored"} {
+		os.RemoveAll(dir)
+	}
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	commit := func(key, value string) {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		if value == "" {
+			tx.Remove([]byte(key))
+		} else {
+			tx.Put([]byte(key), []byte(value))
+		}
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		commit("mykey"+strconv.Itoa(i), "myvalue"+strconv.Itoa(i))
+	}
+	if err = db.Backup("test/backup0", ""); err != nil {
+		t.Fatal("unable to backup", err)
+	}
+
+	// the segments merged after the backup are not copied again
+	if err = db.CloseWithMerge(1); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	commit("mykey1", "")
+	commit("mykey5", "myvalue5")
+	if err = db.Backup("test/backup1", "test/backup0"); err != nil {
+		t.Fatal("unable to backup", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	files, _ := ioutil.ReadDir("test/backup1")
+	count := 0
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".keys.") {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Fatal("incremental backup should only contain the new segments", count)
+	}
+
+	if err = keydb.Restore("test/restored", "test/backup1"); err != keydb.BrokenBackupChain {
+		t.Fatal("expected BrokenBackupChain", err)
+	}
+	if err = keydb.Restore("test/restored", "test/backup0", "test/backup1"); err != nil {
+		t.Fatal("unable to restore", err)
+	}
+	db, err = keydb.Open("test/restored", false)
+	if err != nil {
+		t.Fatal("unable to open restored database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 6; i++ {
+		value, err := tx.Get([]byte("mykey" + strconv.Itoa(i)))
+		if i == 1 {
+			if err != keydb.KeyNotFound {
+				t.Fatal("the key should be removed", string(value), err)
+			}
+		} else if err != nil || string(value) != "myvalue"+strconv.Itoa(i) {
+			t.Fatal("incorrect value", string(value), err)
+		}
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	for _, dir := range []string{"test/backup0", "test/backup1", "test/restored"} {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBackupDroppedTable(t *testing.T) {
+	keydb.Remove("test/mydb")
+	for _, dir := range []string{"test/backup0", "test/backup1", "test/restored"} {
+		os.RemoveAll(dir)
+	}
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	commit := func(value string) {
+		tx, err := db.BeginTX("t")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte("a"), []byte(value))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	commit("old")
+	if err = db.Backup("test/backup0", ""); err != nil {
+		t.Fatal("unable to backup", err)
+	}
+	if err = db.DropTable("t"); err != nil {
+		t.Fatal("unable to drop table", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// the new segment of the table must not reuse the id of the dropped segment in the backup
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	commit("new")
+	if err = db.Backup("test/backup1", "test/backup0"); err != nil {
+		t.Fatal("unable to backup", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	if err = keydb.Restore("test/restored", "test/backup0", "test/backup1"); err != nil {
+		t.Fatal("unable to restore", err)
+	}
+	db, err = keydb.Open("test/restored", false)
+	if err != nil {
+		t.Fatal("unable to open restored database", err)
+	}
+	tx, err := db.BeginTX("t")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte("a")); err != nil || string(value) != "new" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	for _, dir := range []string{"test/backup0", "test/backup1", "test/restored"} {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBackupOpenTransaction(t *testing.T) {
+	keydb.Remove("test/mydb")
+	for _, dir := range []string{"test/backup0", "test/restored"} {
+		os.RemoveAll(dir)
+	}
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey0"), []byte("myvalue0"))
+
+	// the backup waits for the open transaction, and a new one waits for the backup
+	backedUp := make(chan error, 1)
+	go func() {
+		backedUp <- db.Backup("test/backup0", "")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	begun := make(chan *keydb.Transaction, 1)
+	go func() {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Error("unable to create transaction", err)
+		}
+		begun <- tx
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err = tx.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	select {
+	case err := <-backedUp:
+		if err != nil {
+			t.Fatal("unable to backup", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the backup did not complete")
+	}
+	tx = <-begun
+	tx.Put([]byte("mykey1"), []byte("myvalue1"))
+	if err = tx.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	if err = keydb.Restore("test/restored", "test/backup0"); err != nil {
+		t.Fatal("unable to restore", err)
+	}
+	db, err = keydb.Open("test/restored", false)
+	if err != nil {
+		t.Fatal("unable to open restored database", err)
+	}
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte("mykey0")); err != nil || string(value) != "myvalue0" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	if _, err := tx.Get([]byte("mykey1")); err != keydb.KeyNotFound {
+		t.Fatal("the later commit should not be in the backup", err)
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	for _, dir := range []string{"test/backup0", "test/restored"} {
+		os.RemoveAll(dir)
+	}
+}
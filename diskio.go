@@ -6,24 +6,50 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 )
 
-const keyBlockSize = 4096
 const maxKeySize = 1024
 const endOfBlock uint16 = 0x8000
 const compressedBit uint16 = 0x8000
 const maxPrefixLen uint16 = 0xFF ^ 0x80
 const maxCompressedLen uint16 = 0xFF
-const keyIndexInterval int = 2 // record every 16th block
 const removedKeyLen = 0xFFFFFFFF
 
+// the flags of a key entry
+const entryOperands uint8 = 1 // the value is a list of merge operands
+const entryExpires uint8 = 2  // the flags are followed by the expiry of the value
+
+// the format version of the segments written, see diskSegment
+const segmentVersion uint8 = 4
+
+// the first segment version with checksums on key blocks and values
+const checksumVersion uint8 = 1
+const checksumLen = 4
+
+// the first segment version with range tombstones at the end of the data file
+const rangeTombstoneVersion uint8 = 2
+const rangeFooterLen = 12
+
+// the first segment version with flags in the key entries
+const entryFlagsVersion uint8 = 3
+
+// the first segment version with the expiry of a value in the key entry
+const expiryVersion uint8 = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 var errEmptySegment = errors.New("empty segment")
+var errCorruptRanges = errors.New("corrupt range tombstones")
 
-// called to write a memory segment to disk
+// called to write a memory segment of the table to disk. the segment id is assigned, and the segment logged, when the
+// transaction commits. the table is passed by the committer, since the tables of the database cannot be read without
+// the database lock
 // 将segment持久化到磁盘
-func writeSegmentToDisk(db *Database, table string, seg segment) error {
+func writeSegmentToDisk(db *Database, it *internalTable, id uint64, seg segment) error {
 	defer db.wg.Done() // allows database to close with no writers pending
 
 	var err error
@@ -33,21 +59,32 @@ func writeSegmentToDisk(db *Database, table string, seg segment) error {
 		return err
 	}
 
-	id := db.nextSegmentID()
-
-	keyFilename := filepath.Join(db.path, fmt.Sprint(table, ".keys.", id))
-	dataFilename := filepath.Join(db.path, fmt.Sprint(table, ".data.", id))
+	table := it.name
+	keyFilename, dataFilename := segmentFilenames(db.path, table, id)
 
-	ds, err := writeAndLoadSegment(keyFilename, dataFilename, itr)
+	ds, err := writeAndLoadSegment(keyFilename, dataFilename, itr, seg.RangeTombstones(), db.segmentOptions(table))
 	if err != nil && err != errEmptySegment {
 		return err
 	}
 
-	db.tables[table].Lock()
-	defer db.tables[table].Unlock()
+	if ds != nil {
+		err = db.manifest.apply([]manifestChange{{op: addSegment, table: table, info: newSegmentInfo(ds.(*diskSegment))}}, db.durability() >= SyncOnSegmentWrite)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the segment is on disk, so it no longer needs to be recovered from the log
+	err = db.wal.segmentWritten(id)
+	if err != nil {
+		return err
+	}
+
+	it.Lock()
+	defer it.Unlock()
 
 	segments := make([]segment, 0)
-	for _, v := range db.tables[table].segments {
+	for _, v := range it.segments {
 		if v == seg {
 			if ds != nil {
 				segments = append(segments, ds)
@@ -57,44 +94,79 @@ func writeSegmentToDisk(db *Database, table string, seg segment) error {
 		}
 	}
 
-	db.tables[table].segments = segments
+	it.segments = segments
 
 	return nil
 }
 
+func segmentFilenames(dbpath string, table string, id uint64) (keyFilename, dataFilename string) {
+	keyFilename = filepath.Join(dbpath, fmt.Sprint(table, ".keys.", id))
+	dataFilename = filepath.Join(dbpath, fmt.Sprint(table, ".data.", id))
+	return
+}
+
 // 将迭代器包含的数据全部写入给定key/data文件，并封装成diskSegment返回
-func writeAndLoadSegment(keyFilename, dataFilename string, itr LookupIterator) (segment, error) {
+// if options.sync is true the files and their directory are synced before the segment is returned
+func writeAndLoadSegment(keyFilename, dataFilename string, itr LookupIterator, ranges []Range, options segmentOptions) (segment, error) {
 
 	keyFilenameTmp := keyFilename + ".tmp"
 	dataFilenameTmp := dataFilename + ".tmp"
 
-	keyIndex, err := writeSegmentFiles(keyFilenameTmp, dataFilenameTmp, itr)
+	keyIndex, filter, err := writeSegmentFiles(keyFilenameTmp, dataFilenameTmp, itr, ranges, options)
 	if err != nil {
 		os.Remove(keyFilenameTmp)
 		os.Remove(dataFilenameTmp)
 		return nil, err
 	}
 
-	os.Rename(keyFilenameTmp, keyFilename)
-	os.Rename(dataFilenameTmp, dataFilename)
+	// the filter is renamed first, so a segment never exists without the filter it was written with
+	if filter != nil {
+		filterFilename := bloomFilename(keyFilename)
+		err := writeBloomFilter(filterFilename+".tmp", filter, options.sync)
+		if err == nil {
+			err = os.Rename(filterFilename+".tmp", filterFilename)
+		}
+		if err != nil {
+			os.Remove(filterFilename + ".tmp")
+			os.Remove(keyFilenameTmp)
+			os.Remove(dataFilenameTmp)
+			return nil, err
+		}
+	}
+
+	err0 := os.Rename(keyFilenameTmp, keyFilename)
+	err1 := os.Rename(dataFilenameTmp, dataFilename)
+	if err := errn(err0, err1); err != nil {
+		return nil, err
+	}
 
-	return newDiskSegment(keyFilename, dataFilename, keyIndex), nil
+	if options.sync {
+		// the renames are only durable once the directory is synced
+		if err := syncDir(filepath.Dir(keyFilename)); err != nil {
+			return nil, err
+		}
+	}
+
+	return newDiskSegment(keyFilename, dataFilename, segmentVersion, options, keyIndex, filter)
 }
 
 // 将迭代器包含的数据全部写入给定key/data文件，返回写入记录的key集合
-func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte, error) {
+// and the bloom filter of the keys, which is nil if options.bloomBitsPerKey is not positive. the range tombstones
+// are written after the values. a segment with range tombstones but no keys has an empty key file
+func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator, ranges []Range, options segmentOptions) ([][]byte, *bloomFilter, error) {
 
 	var keyIndex [][]byte
+	var hashes []uint64
 
 	keyF, err := os.OpenFile(keyFName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer keyF.Close()
 
 	dataF, err := os.OpenFile(dataFName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer dataF.Close()
 
@@ -106,31 +178,57 @@ func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte
 	var keyCount = 0
 	var block = 0
 
-	var zeros = make([]byte, keyBlockSize)
+	// the key block being built, written when full so that its checksum can be calculated
+	keyBlock := new(bytes.Buffer)
+	var checksum [checksumLen]byte
 
 	var prevKey []byte
 
 	for {
 		key, value, err := itr.Next()
-		if err != nil {
+		if err == EndOfIterator {
 			break
 		}
+		// such as a corrupt block of a merged segment, or a merge operand that could not be applied. the segment must
+		// not be written without the keys, since a merge removes its sources
+		if err != nil {
+			return nil, nil, err
+		}
+		var flags uint8
+		var expires int64
+		if value != nil && itr.operands() {
+			flags |= entryOperands
+		}
+		if value != nil && itr.expiry() != 0 {
+			flags |= entryExpires
+			expires = itr.expiry()
+		}
+		entryLen := 2 + len(key) + 8 + 4 + 1
+		if flags&entryExpires != 0 {
+			entryLen += 8
+		}
 		keyCount++
+		if options.bloomBitsPerKey > 0 {
+			hashes = append(hashes, bloomHash(key))
+		}
 
-		if _, err := dataW.Write(value); err != nil {
-			return nil, err
+		if value != nil {
+			if _, err := dataW.Write(value); err != nil {
+				return nil, nil, err
+			}
+			binary.LittleEndian.PutUint32(checksum[:], crc32.Checksum(value, crcTable))
+			if _, err := dataW.Write(checksum[:]); err != nil {
+				return nil, nil, err
+			}
 		}
 
 		// 判断key已经达到写入目标块大小
-		if keyBlockLen+2+len(key)+8+4 >= keyBlockSize-2 { // need to leave room for 'end of block marker'
+		if keyBlockLen+entryLen >= options.blockSize-2-checksumLen { // need to leave room for 'end of block marker' and checksum
 			// key won't fit in block so move to next
-			if err := binary.Write(keyW, binary.LittleEndian, endOfBlock); err != nil {
-				return nil, err
-			}
-			keyBlockLen += 2
-			if _, err := keyW.Write(zeros[:keyBlockSize-keyBlockLen]); err != nil {
-				return nil, err
+			if err := writeKeyBlock(keyW, keyBlock.Bytes(), options.blockSize); err != nil {
+				return nil, nil, err
 			}
+			keyBlock.Reset()
 			keyBlockLen = 0
 			prevKey = nil
 		}
@@ -138,7 +236,7 @@ func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte
 		// key块长度为0, 第一次进入循环必定满足
 		if keyBlockLen == 0 {
 			// 稀疏索引策略，每隔{keyIndexInterval}个key持久化一个
-			if block%keyIndexInterval == 0 {
+			if block%options.keyIndexInterval == 0 {
 				// 将[]key的值append到[][]keyIndex二位数组
 				keycopy := make([]byte, len(key))
 				copy(keycopy, key)
@@ -163,7 +261,11 @@ func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte
 			uint16(dk.keylen),
 			dk.compressedKey,
 			int64(dataOffset),
-			uint32(dataLen)}
+			uint32(dataLen),
+			flags}
+		if flags&entryExpires != 0 {
+			data = append(data, expires)
+		}
 		buf := new(bytes.Buffer)
 		for _, v := range data {
 			err = binary.Write(buf, binary.LittleEndian, v)
@@ -171,9 +273,7 @@ func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte
 				goto failed
 			}
 		}
-		if _, err := keyW.Write(buf.Bytes()); err != nil {
-			return nil, err
-		}
+		keyBlock.Write(buf.Bytes())
 
 		// 记录key块的长度
 		// key块的结构为:
@@ -181,41 +281,128 @@ func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte
 		// key实体[变长]
 		// key指向的data偏移量[固定8字节], 理论上最多可寻址2^64的磁盘地址
 		// key指向的data长度[固定4字节], 单个data最多保存2^32b=4GB的数据
-		keyBlockLen += 2 + len(dk.compressedKey) + 8 + 4
+		// flags[固定1字节]
+		// 过期时间[8字节, 仅当flags包含entryExpires]
+		keyBlockLen += entryLen - len(key) + len(dk.compressedKey)
 		// 累加记录value块的偏移
 		if value != nil {
-			dataOffset += int64(dataLen)
+			dataOffset += int64(dataLen) + checksumLen
 		}
 	}
 
 	// pad key file to block size
-	if keyBlockLen > 0 && keyBlockLen < keyBlockSize {
-		// key won't fit in block so move to next
-		if err := binary.Write(keyW, binary.LittleEndian, endOfBlock); err != nil {
-			return nil, err
-		}
-		keyBlockLen += 2
-		if _, err := keyW.Write(zeros[:keyBlockSize-keyBlockLen]); err != nil {
-			return nil, err
+	if keyBlockLen > 0 && keyBlockLen < options.blockSize {
+		if err := writeKeyBlock(keyW, keyBlock.Bytes(), options.blockSize); err != nil {
+			return nil, nil, err
 		}
 		keyBlockLen = 0
 	}
 
+	if _, err := dataW.Write(encodeRangeTombstones(ranges)); err != nil {
+		return nil, nil, err
+	}
+
 	if err := keyW.Flush(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := dataW.Flush(); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if options.sync {
+		if err := dataF.Sync(); err != nil {
+			return nil, nil, err
+		}
+		if err := keyF.Sync(); err != nil {
+			return nil, nil, err
+		}
 	}
 
-	if keyCount == 0 {
-		return nil, errEmptySegment
+	if keyCount == 0 && len(ranges) == 0 {
+		return nil, nil, errEmptySegment
 	}
 
-	return keyIndex, nil
+	if options.bloomBitsPerKey > 0 && keyCount > 0 {
+		return keyIndex, newBloomFilter(hashes, options.bloomBitsPerKey), nil
+	}
+
+	return keyIndex, nil, nil
 
 failed:
-	return nil, err
+	return nil, nil, err
+}
+
+// encodes the range tombstones written at the end of the data file, the format is
+// ranges (see appendRange)
+// count uint32
+// length uint32 (the length of the encoded ranges)
+// checksum uint32 (the CRC32C of the rest)
+func encodeRangeTombstones(ranges []Range) []byte {
+	var buf []byte
+	for _, r := range ranges {
+		buf = appendRange(buf, r)
+	}
+	length := len(buf)
+	var footer [rangeFooterLen]byte
+	binary.LittleEndian.PutUint32(footer[0:], uint32(len(ranges)))
+	binary.LittleEndian.PutUint32(footer[4:], uint32(length))
+	buf = append(buf, footer[:8]...)
+	binary.LittleEndian.PutUint32(footer[8:], crc32.Checksum(buf, crcTable))
+	return append(buf, footer[8:]...)
+}
+
+// decodes the range tombstones at the end of a data file of the given size
+func readRangeTombstones(r io.ReaderAt, size int64) ([]Range, error) {
+	if size < rangeFooterLen {
+		return nil, errCorruptRanges
+	}
+	var footer [rangeFooterLen]byte
+	if _, err := r.ReadAt(footer[:], size-rangeFooterLen); err != nil {
+		return nil, err
+	}
+	count := binary.LittleEndian.Uint32(footer[0:])
+	length := int64(binary.LittleEndian.Uint32(footer[4:]))
+	if length > size-rangeFooterLen {
+		return nil, errCorruptRanges
+	}
+	buf := make([]byte, length+8)
+	if _, err := r.ReadAt(buf, size-rangeFooterLen-length); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(buf, crcTable) != binary.LittleEndian.Uint32(footer[8:]) {
+		return nil, errCorruptRanges
+	}
+	buf = buf[:length]
+	var ranges []Range
+	for i := uint32(0); i < count; i++ {
+		var r Range
+		var ok bool
+		if r, buf, ok = decodeRange(buf); !ok {
+			return nil, errCorruptRanges
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// completes a key block with the end of block marker, padding and checksum, and writes it
+func writeKeyBlock(w io.Writer, keys []byte, blockSize int) error {
+	block := make([]byte, blockSize)
+	copy(block, keys)
+	binary.LittleEndian.PutUint16(block[len(keys):], endOfBlock)
+	binary.LittleEndian.PutUint32(block[blockSize-checksumLen:], crc32.Checksum(block[:blockSize-checksumLen], crcTable))
+	_, err := w.Write(block)
+	return err
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err0 := d.Sync()
+	err1 := d.Close()
+	return errn(err0, err1)
 }
 
 type diskkey struct {
@@ -252,13 +439,6 @@ func decodeKeyLen(keylen uint16) (prefixLen, compressedLen uint16, err error) {
 	return
 }
 
-func decodeKey(key, prevKey []byte, prefixLen uint16) []byte {
-	if prefixLen != 0 {
-		key = append(prevKey[:prefixLen], key...)
-	}
-	return key
-}
-
 func calculatePrefixLen(prevKey []byte, key []byte) int {
 	if prevKey == nil {
 		return 0
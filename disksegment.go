@@ -1,19 +1,20 @@
 package keydb
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
-// the key file uses 4096 byte blocks, the format is
+// the key file uses fixed size blocks, 4096 bytes by default, the format is
 // keylen uint16
 // key []byte
 // dataoffset int64
@@ -29,60 +30,82 @@ import (
 // file since there is no length attribute, it is a raw appended
 // byte array with the offset and length in the key file
 //
+// since segment version 1 the last 4 bytes of every key block are the CRC32C of the rest of
+// the block, and every value in the data file is followed by the CRC32C of the value. the
+// version of a segment is recorded in the manifest
+//
+// since segment version 2 the data file ends with the range tombstones of the segment, see encodeRangeTombstones.
+// a segment can consist of only range tombstones, and then the key file is empty
+//
+// since segment version 3 datalen is followed by
+// flags uint8 (entryOperands if the value is a list of merge operands)
+//
+// since segment version 4 the flags are followed by
+// expires int64 (if the flags include entryExpires, the time the value expires in unix nanoseconds)
+//
+// an expired value is read as a removed key
 type diskSegment struct {
 	keyFile   *os.File
 	keyBlocks int64 // 数据块数量
 	dataFile  *os.File
 	id        uint64
+	low       uint64 // the lowest segment id replaced by this segment, if it is the result of a merge
+	table     string
+	version   uint8 // the file format version
+	blockSize int
 	// nil for segments loaded during initial open
 	// otherwise holds the key for every keyIndexInterval block
-	keyIndex [][]byte
+	keyIndex         [][]byte
+	keyIndexInterval int
+	filter           *bloomFilter // nil if the segment has no filter
+	stats            *filterStats
+	cache            *blockCache
+	cacheID          uint64 // identifies the blocks of the segment in the cache
+	cmp              Comparator
+	ranges           []Range // the range tombstones
+	// the table and every read only transaction using the segment hold a reference, once the segment is replaced
+	// by a merge its files are removed when the last reference is released. accessed atomically
+	refs     int32
+	obsolete int32
 }
 
 type diskSegmentIterator struct {
-	segment      *diskSegment
-	lower        []byte
-	upper        []byte
-	buffer       []byte
-	block        int64
-	bufferOffset int
-	key          []byte
-	data         []byte
-	isValid      bool
-	err          error
-	finished     bool
+	segment  *diskSegment
+	r        Range
+	kb       *keyBlock // the current block
+	block    int64
+	index    int  // the next key in the block
+	reverse  bool // iterate the blocks and keys in descending order
+	key      []byte
+	data     []byte
+	merge    bool  // data is a list of merge operands
+	expires  int64 // the expiry of data
+	now      int64 // the values that expired before the iteration started are returned as removed
+	isValid  bool
+	err      error
+	finished bool
 }
 
 var errKeyRemoved = errors.New("key removed")
+var errCorruptBlock = errors.New("corrupt key block")
 
-// 从指定目录读取指定table的key/data文件(以{table}.开头)，并解析为segment数组返回. 如果没有指定的文件，返回空数组
-func loadDiskSegments(directory string, table string) []segment {
-	files, err := ioutil.ReadDir(directory)
-	if err != nil {
-		return []segment{}
-	}
+// opens the segments of a table recorded in the manifest, each with the block size it was written with
+func loadDiskSegments(directory string, infos []segmentInfo, options segmentOptions) ([]segment, error) {
 	segments := []segment{}
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".tmp") {
-			panic("tmp files in " + directory)
-		}
-		if strings.HasPrefix(file.Name(), table+".") {
-			index := strings.Index(file.Name(), ".keys.")
-			if index < 0 {
-				continue
-
+	for _, info := range infos {
+		keyFilename := filepath.Join(directory, info.keyFile)
+		dataFilename := filepath.Join(directory, info.dataFile)
+		options.blockSize = info.blockSize
+		ds, err := newDiskSegment(keyFilename, dataFilename, info.version, options, nil, nil) // don't have keyIndex
+		if err != nil {
+			for _, s := range segments {
+				s.Close()
 			}
-			base := file.Name()[:index]
-			id := getSegmentID(file.Name())
-			keyFilename := filepath.Join(directory, base+".keys."+strconv.FormatUint(id, 10))
-			dataFilename := filepath.Join(directory, base+".data."+strconv.FormatUint(id, 10))
-			segments = append(segments, newDiskSegment(keyFilename, dataFilename, nil)) // don't have keyIndex
+			return nil, err
 		}
+		segments = append(segments, ds)
 	}
-	sort.Slice(segments, func(i, j int) bool {
-		return segments[i].(*diskSegment).id < segments[j].(*diskSegment).id
-	})
-	return segments
+	return segments, nil
 }
 
 func getSegmentID(filename string) uint64 {
@@ -97,50 +120,104 @@ func getSegmentID(filename string) uint64 {
 	return 0
 }
 
+// returns the range of segment ids covered by a segment file, a merged segment replaces all segments in its range
+func getSegmentRange(filename string) (low, id uint64) {
+	id = getSegmentID(filename)
+	low = id
+
+	base := filepath.Base(filename)
+	index := strings.Index(base, ".merged.")
+	if index < 0 {
+		return
+	}
+	parts := strings.Split(base[index+len(".merged."):], ".")
+	if v, err := strconv.ParseUint(parts[0], 10, 64); err == nil && v <= id {
+		low = v
+	}
+	return
+}
+
 // 将一个key/data文件对映射为一个diskSegment
 // keyIndex: 为nil时(在读取文件生成diskSegment时)会从key文件读取; 不为nil(写入数据到文件时)则直接使用keyIndex作为返回diskSegment的索引
-func newDiskSegment(keyFilename, dataFilename string, keyIndex [][]byte) segment {
+// options.blockSize must be the block size the segment was written with
+// filter: 为nil时会从bloom文件读取, 文件不存在时segment没有filter
+func newDiskSegment(keyFilename, dataFilename string, version uint8, options segmentOptions, keyIndex [][]byte, filter *bloomFilter) (segment, error) {
 
-	segmentID := getSegmentID(keyFilename)
+	low, segmentID := getSegmentRange(keyFilename)
 
 	ds := &diskSegment{}
 	kf, err := os.Open(keyFilename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	df, err := os.Open(dataFilename)
 	if err != nil {
-		panic(err)
+		kf.Close()
+		return nil, err
 	}
 	ds.keyFile = kf
 	ds.dataFile = df
 
-	fi, err := kf.Stat()
-	if err != nil {
-		panic(err)
+	fi, err0 := kf.Stat()
+	dfi, err1 := df.Stat()
+	if err := errn(err0, err1); err != nil {
+		kf.Close()
+		df.Close()
+		return nil, err
 	}
 
-	ds.keyBlocks = (fi.Size()-1)/keyBlockSize + 1 // key block数量
+	ds.blockSize = options.blockSize
+	ds.keyIndexInterval = options.keyIndexInterval
+	ds.keyBlocks = (fi.Size()-1)/int64(ds.blockSize) + 1 // key block数量
+	if fi.Size() == 0 {
+		ds.keyBlocks = 0
+	}
 	ds.id = segmentID
+	ds.low = low
+	ds.table = getTableName(keyFilename)
+	ds.version = version
+
+	if version >= rangeTombstoneVersion {
+		ds.ranges, err = readRangeTombstones(df, dfi.Size())
+		if err != nil {
+			kf.Close()
+			df.Close()
+			// a truncated footer is read past the end of the file
+			if err == errCorruptRanges || err == io.EOF {
+				err = &CorruptionError{Table: ds.table, SegmentID: ds.id, Block: -1, Ranges: true}
+			}
+			return nil, err
+		}
+	}
 
 	if keyIndex == nil {
 		// TODO maybe load this in the background
-		keyIndex = loadKeyIndex(kf, ds.keyBlocks)
+		keyIndex = ds.loadKeyIndex()
 	}
 
 	ds.keyIndex = keyIndex
 
-	return ds
+	if filter == nil {
+		filter = readBloomFilter(bloomFilename(keyFilename))
+	}
+	ds.filter = filter
+	ds.stats = options.stats
+	ds.cache = options.cache
+	ds.cacheID = newCacheID()
+	ds.cmp = options.cmp
+	ds.refs = 1
+
+	return ds, nil
 }
 
 // 从索引文件kf构建索引
-func loadKeyIndex(kf *os.File, keyBlocks int64) [][]byte {
-	buffer := make([]byte, keyBlockSize)
+func (ds *diskSegment) loadKeyIndex() [][]byte {
+	buffer := make([]byte, ds.blockSize)
 	keyIndex := make([][]byte, 0)
 	// build key index
 	var block int64
-	for block = 0; block < keyBlocks; block += int64(keyIndexInterval) {
-		_, err := kf.ReadAt(buffer, block*keyBlockSize)
+	for block = 0; block < ds.keyBlocks; block += int64(ds.keyIndexInterval) {
+		err := ds.readBlock(block, buffer)
 		if err != nil {
 			keyIndex = nil
 			break
@@ -156,6 +233,63 @@ func loadKeyIndex(kf *os.File, keyBlocks int64) [][]byte {
 	return keyIndex
 }
 
+// reads a key block, verifying its checksum if the segment has them
+func (ds *diskSegment) readBlock(block int64, buffer []byte) error {
+	n, err := ds.keyFile.ReadAt(buffer, block*int64(ds.blockSize))
+	if err != nil {
+		return err
+	}
+	// 异常! 读取到不完整的数据块
+	if n != ds.blockSize {
+		return errors.New(fmt.Sprint("did not read block size, read ", n))
+	}
+	if ds.version >= checksumVersion {
+		checksum := binary.LittleEndian.Uint32(buffer[ds.blockSize-checksumLen:])
+		if crc32.Checksum(buffer[:ds.blockSize-checksumLen], crcTable) != checksum {
+			return &CorruptionError{Table: ds.table, SegmentID: ds.id, Block: block}
+		}
+	}
+	return nil
+}
+
+// returns the decoded key block, from the cache if possible
+func (ds *diskSegment) keyBlock(block int64) (*keyBlock, error) {
+	if kb := ds.cache.get(ds.cacheID, block); kb != nil {
+		return kb, nil
+	}
+	buffer := make([]byte, ds.blockSize)
+	if err := ds.readBlock(block, buffer); err != nil {
+		return nil, err
+	}
+	kb, err := decodeKeyBlock(buffer, ds.version)
+	if err != nil {
+		return nil, &CorruptionError{Table: ds.table, SegmentID: ds.id, Block: block}
+	}
+	ds.cache.put(ds.cacheID, block, kb)
+	return kb, nil
+}
+
+// reads the value for a key found in block, verifying its checksum if the segment has them
+func (ds *diskSegment) readValue(block int64, offset int64, length uint32) ([]byte, error) {
+	if ds.version < checksumVersion {
+		value := make([]byte, length)
+		_, err := ds.dataFile.ReadAt(value, offset)
+		if err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	buffer := make([]byte, int(length)+checksumLen)
+	_, err := ds.dataFile.ReadAt(buffer, offset)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(buffer[:length], crcTable) != binary.LittleEndian.Uint32(buffer[length:]) {
+		return nil, &CorruptionError{Table: ds.table, SegmentID: ds.id, Block: block, Value: true, Offset: offset}
+	}
+	return buffer[:length:length], nil
+}
+
 // 从diskSegment迭代读取数据
 func (dsi *diskSegmentIterator) Next() (key []byte, value []byte, err error) {
 	if dsi.isValid {
@@ -167,6 +301,14 @@ func (dsi *diskSegmentIterator) Next() (key []byte, value []byte, err error) {
 	return dsi.key, dsi.data, dsi.err
 }
 
+func (dsi *diskSegmentIterator) operands() bool {
+	return dsi.merge
+}
+
+func (dsi *diskSegmentIterator) expiry() int64 {
+	return dsi.expires
+}
+
 func (dsi *diskSegmentIterator) peekKey() ([]byte, error) {
 	if dsi.isValid {
 		return dsi.key, dsi.err
@@ -179,159 +321,216 @@ func (dsi *diskSegmentIterator) nextKeyValue() error {
 	if dsi.finished {
 		return EndOfIterator
 	}
-	var prevKey = dsi.key
+	if dsi.reverse {
+		return dsi.prevKeyValue()
+	}
 
 	for {
-		// 读取16bit的数据
-		keylen := binary.LittleEndian.Uint16(dsi.buffer[dsi.bufferOffset:])
-		// 读到key结束块
-		if keylen == endOfBlock {
+		// 当前块消费完毕
+		if dsi.index == len(dsi.kb.keys) {
 			dsi.block++
 			// 消费过的块数量 等于 当前diskSegment标记的最大数据块，此segment消费完毕
 			if dsi.block == dsi.segment.keyBlocks {
-				dsi.finished = true
-				dsi.err = EndOfIterator
-				dsi.key = nil
-				dsi.data = nil
-				dsi.isValid = true
-				return dsi.err
+				return dsi.fail(EndOfIterator)
 			}
-			// 消费一个新的块，数据缓存在dsi.buffer
-			n, err := dsi.segment.keyFile.ReadAt(dsi.buffer, dsi.block*keyBlockSize)
+			kb, err := dsi.segment.keyBlock(dsi.block)
 			if err != nil {
-				return err
+				return dsi.fail(err)
 			}
-			// 异常! 读取到不完整的数据块
-			if n != keyBlockSize {
-				return errors.New(fmt.Sprint("did not read block size, read ", n))
-			}
-			// 从头(0)开始消费数据块
-			dsi.bufferOffset = 0
-			prevKey = nil
+			dsi.kb = kb
+			dsi.index = 0
 			continue
 		}
 
-		/*解析一个key*/
-		prefixLen, compressedLen, err := decodeKeyLen(keylen)
-		if err != nil {
-			return err
-		}
-
-		dsi.bufferOffset += 2
-		key := dsi.buffer[dsi.bufferOffset : dsi.bufferOffset+int(compressedLen)]
-		dsi.bufferOffset += int(compressedLen)
-
-		key = decodeKey(key, prevKey, prefixLen)
+		key := dsi.kb.keys[dsi.index]
+		dataoffset := dsi.kb.offsets[dsi.index]
+		datalen := dsi.kb.lengths[dsi.index]
+		merge := dsi.kb.operands(dsi.index)
+		expires := dsi.kb.expiry(dsi.index)
+		dsi.index++
 
-		// 解析key对应的data的下标
-		dataoffset := binary.LittleEndian.Uint64(dsi.buffer[dsi.bufferOffset:])
-		dsi.bufferOffset += 8 // Uint64 = 8byte
-		// 解析key对应的data的长度
-		datalen := binary.LittleEndian.Uint32(dsi.buffer[dsi.bufferOffset:])
-		dsi.bufferOffset += 4 // Uint32 = 4byte
+		/* 指定了区间，则继续循环，直到找出目标区间的key */
+		if dsi.r.before(dsi.segment.cmp, key) {
+			continue
+		}
+		if dsi.r.after(dsi.segment.cmp, key) {
+			return dsi.fail(EndOfIterator)
+		}
 
-		prevKey = key
+		if expired(expires, dsi.now) {
+			datalen, merge, expires = removedKeyLen, false, 0
+		}
 
-		/* 指定了区间，则继续循环，直到找出目标区间的key */
-		if dsi.lower != nil {
-			if less(key, dsi.lower) {
-				continue
-			}
-			if equal(key, dsi.lower) {
-				goto found
+		var err error
+		if datalen == removedKeyLen {
+			// 被更新移除的键
+			dsi.data = nil
+		} else {
+			// 从dataFile读取从{dataoffset}开始的，{datalen}长度的数据到dsi.data
+			dsi.data, err = dsi.segment.readValue(dsi.block, dataoffset, datalen)
+			if err != nil {
+				return dsi.fail(err)
 			}
 		}
-		if dsi.upper != nil {
-			if equal(key, dsi.upper) {
-				goto found
+		dsi.key = key
+		dsi.merge = merge
+		dsi.expires = expires
+		// 标记迭代器完成了一次数据读取
+		dsi.isValid = true
+		return nil
+	}
+}
+
+// the next key of a reverse iteration, which walks the key blocks backwards
+func (dsi *diskSegmentIterator) prevKeyValue() error {
+	for {
+		// 当前块消费完毕
+		if dsi.index < 0 {
+			dsi.block--
+			if dsi.block < 0 {
+				return dsi.fail(EndOfIterator)
 			}
-			if !less(key, dsi.upper) {
-				dsi.finished = true
-				dsi.isValid = true
-				dsi.key = nil
-				dsi.data = nil
-				dsi.err = EndOfIterator
-				return EndOfIterator
+			kb, err := dsi.segment.keyBlock(dsi.block)
+			if err != nil {
+				return dsi.fail(err)
 			}
+			dsi.kb = kb
+			dsi.index = len(kb.keys) - 1
+			continue
+		}
+
+		key := dsi.kb.keys[dsi.index]
+		dataoffset := dsi.kb.offsets[dsi.index]
+		datalen := dsi.kb.lengths[dsi.index]
+		merge := dsi.kb.operands(dsi.index)
+		expires := dsi.kb.expiry(dsi.index)
+		dsi.index--
+
+		if dsi.r.after(dsi.segment.cmp, key) {
+			continue
+		}
+		if dsi.r.before(dsi.segment.cmp, key) {
+			return dsi.fail(EndOfIterator)
 		}
-	found:
 
+		if expired(expires, dsi.now) {
+			datalen, merge, expires = removedKeyLen, false, 0
+		}
+
+		var err error
 		if datalen == removedKeyLen {
-			// 被更新移除的键
 			dsi.data = nil
 		} else {
-			// 从dataFile读取从{dataoffset}开始的，{datalen}长度的数据到dsi.data
-			dsi.data = make([]byte, datalen)
-			_, err = dsi.segment.dataFile.ReadAt(dsi.data, int64(dataoffset))
+			dsi.data, err = dsi.segment.readValue(dsi.block, dataoffset, datalen)
+			if err != nil {
+				return dsi.fail(err)
+			}
 		}
-		// key
 		dsi.key = key
-		// 标记迭代器完成了一次数据读取
+		dsi.merge = merge
+		dsi.expires = expires
 		dsi.isValid = true
-		return err
+		return nil
 	}
 }
 
+// ends the iteration with an error, such as a corrupt block
+func (dsi *diskSegmentIterator) fail(err error) error {
+	dsi.finished = true
+	dsi.isValid = true
+	dsi.key = nil
+	dsi.data = nil
+	dsi.err = err
+	return err
+}
+
 func (ds *diskSegment) Put(key []byte, value []byte) error {
 	panic("disk segments are not mutable, unable to Put")
 }
 
+func (ds *diskSegment) PutOperands(key []byte, operands []byte) error {
+	panic("disk segments are not mutable, unable to PutOperands")
+}
+
+func (ds *diskSegment) PutExpiring(key []byte, value []byte, expires int64) error {
+	panic("disk segments are not mutable, unable to PutExpiring")
+}
+
 func (ds *diskSegment) Get(key []byte) ([]byte, error) {
-	offset, len, err := binarySearch(ds, key)
+	value, _, err := ds.GetEntry(key)
+	return value, err
+}
+
+func (ds *diskSegment) GetEntry(key []byte) ([]byte, bool, error) {
+	if ds.filter != nil {
+		if !ds.filter.mayContain(key) {
+			ds.stats.check(true)
+			return nil, false, KeyNotFound
+		}
+		ds.stats.check(false)
+	}
+	block, kb, index, err := binarySearch(ds, key)
+	if err == KeyNotFound && ds.filter != nil {
+		ds.stats.falsePositive()
+	}
 	if err == errKeyRemoved {
-		return nil, nil
+		return nil, false, nil
 	}
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	buffer := make([]byte, len)
-	_, err = ds.dataFile.ReadAt(buffer, offset)
-	if err != nil {
-		return nil, err
+	if expired(kb.expiry(index), nowNanos()) {
+		return nil, false, nil
 	}
-	return buffer, nil
+	value, err := ds.readValue(block, kb.offsets[index], kb.lengths[index])
+	return value, kb.operands(index), err
 }
 
-func binarySearch(ds *diskSegment, key []byte) (offset int64, length uint32, err error) {
-	buffer := make([]byte, keyBlockSize)
-
+// returns the key block containing the key, and the index of the key in the block
+func binarySearch(ds *diskSegment, key []byte) (block int64, kb *keyBlock, index int, err error) {
 	var lowblock int64 = 0
 	highblock := ds.keyBlocks - 1
 
+	if ds.keyBlocks == 0 {
+		return 0, nil, 0, KeyNotFound
+	}
+
 	if ds.keyIndex != nil { // we have memory index, so narrow block range down
 		index := sort.Search(len(ds.keyIndex), func(i int) bool {
-			return less(key, ds.keyIndex[i])
+			return lessKeys(ds.cmp, key, ds.keyIndex[i])
 		})
 
 		if index == 0 {
-			return 0, 0, KeyNotFound
+			return 0, nil, 0, KeyNotFound
 		}
 
 		index--
 
-		lowblock = int64(index * keyIndexInterval)
-		highblock = lowblock + int64(keyIndexInterval)
+		lowblock = int64(index * ds.keyIndexInterval)
+		highblock = lowblock + int64(ds.keyIndexInterval)
 
 		if highblock >= ds.keyBlocks {
 			highblock = ds.keyBlocks - 1
 		}
 	}
 
-	block, err := binarySearch0(ds, lowblock, highblock, key, buffer)
+	block, err = binarySearch0(ds, lowblock, highblock, key)
 	if err != nil {
-		return 0, 0, err
+		return 0, nil, 0, err
 	}
-	return scanBlock(ds, block, key, buffer)
+	kb, index, err = scanBlock(ds, block, key)
+	return block, kb, index, err
 }
 
 // returns the block that may contain the key, or possible the next block - since we do not have a 'last key' of the block
-func binarySearch0(ds *diskSegment, lowBlock int64, highBlock int64, key []byte, buffer []byte) (int64, error) {
+func binarySearch0(ds *diskSegment, lowBlock int64, highBlock int64, key []byte) (int64, error) {
 	if highBlock-lowBlock <= 1 {
 		// the key is either in low block or high block, or does not exist, so check high block
-		ds.keyFile.ReadAt(buffer, highBlock*keyBlockSize)
-		keylen := binary.LittleEndian.Uint16(buffer)
-		skey := buffer[2 : 2+keylen]
-		if less(key, skey) {
+		skey, err := firstKey(ds, highBlock)
+		if err != nil {
+			return 0, err
+		}
+		if lessKeys(ds.cmp, key, skey) {
 			return lowBlock, nil
 		} else {
 			return highBlock, nil
@@ -340,88 +539,124 @@ func binarySearch0(ds *diskSegment, lowBlock int64, highBlock int64, key []byte,
 
 	block := (highBlock-lowBlock)/2 + lowBlock
 
-	ds.keyFile.ReadAt(buffer, block*keyBlockSize)
-	keylen := binary.LittleEndian.Uint16(buffer)
-	skey := buffer[2 : 2+keylen]
+	skey, err := firstKey(ds, block)
+	if err != nil {
+		return 0, err
+	}
 
-	if less(key, skey) {
-		return binarySearch0(ds, lowBlock, block, key, buffer)
+	if lessKeys(ds.cmp, key, skey) {
+		return binarySearch0(ds, lowBlock, block, key)
 	} else {
-		return binarySearch0(ds, block, highBlock, key, buffer)
+		return binarySearch0(ds, block, highBlock, key)
 	}
 }
 
-func scanBlock(ds *diskSegment, block int64, key []byte, buffer []byte) (offset int64, len uint32, err error) {
-	_, err = ds.keyFile.ReadAt(buffer, block*keyBlockSize)
+func firstKey(ds *diskSegment, block int64) ([]byte, error) {
+	kb, err := ds.keyBlock(block)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
+	if len(kb.keys) == 0 {
+		return nil, &CorruptionError{Table: ds.table, SegmentID: ds.id, Block: block}
+	}
+	return kb.keys[0], nil
+}
 
-	index := 0
-	var prevKey []byte = nil
-	for {
-		keylen := binary.LittleEndian.Uint16(buffer[index:])
-		if keylen == endOfBlock {
-			return 0, 0, KeyNotFound
-		}
-
-		var compressedLen = keylen
-		var prefixLen = 0
-
-		if keylen&compressedBit != 0 {
-			prefixLen = int((keylen >> 8) & maxPrefixLen)
-			compressedLen = keylen & maxCompressedLen
-		}
-
-		endkey := index + 2 + int(compressedLen)
-		_key := buffer[index+2 : endkey]
-
-		if prefixLen > 0 {
-			_key = append(prevKey[:prefixLen], _key...)
-		}
-
-		prevKey = _key
+func scanBlock(ds *diskSegment, block int64, key []byte) (kb *keyBlock, index int, err error) {
+	kb, err = ds.keyBlock(block)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		if bytes.Equal(_key, key) {
-			offset = int64(binary.LittleEndian.Uint64(buffer[endkey:]))
-			len = binary.LittleEndian.Uint32(buffer[endkey+8:])
-			if len == removedKeyLen {
-				err = errKeyRemoved
-			}
-			return
-		}
-		if !less(_key, key) {
-			return 0, 0, KeyNotFound
-		}
-		index = endkey + 12
+	index = sort.Search(len(kb.keys), func(i int) bool {
+		return !lessKeys(ds.cmp, kb.keys[i], key)
+	})
+	if index == len(kb.keys) || !equalKeys(ds.cmp, kb.keys[index], key) {
+		return nil, 0, KeyNotFound
+	}
+	if kb.lengths[index] == removedKeyLen {
+		err = errKeyRemoved
 	}
+	return
 }
 
 func (ds *diskSegment) Remove(key []byte) ([]byte, error) {
 	panic("disk segments are immutable, unable to Remove")
 }
 
+func (ds *diskSegment) RemoveRange(r Range) error {
+	panic("disk segments are immutable, unable to RemoveRange")
+}
+
+func (ds *diskSegment) RangeTombstones() []Range {
+	return ds.ranges
+}
+
 func (ds *diskSegment) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
-	buffer := make([]byte, keyBlockSize)
+	return ds.LookupRange(Range{Lower: lower, Upper: upper}, false)
+}
+
+func (ds *diskSegment) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	return ds.LookupRange(Range{Lower: lower, Upper: upper}, true)
+}
+
+// the iteration starts at the block that may contain the first key of the range, the lower bound or for a reverse
+// iteration the upper bound, and ends at the first key outside of the range
+func (ds *diskSegment) LookupRange(r Range, reverse bool) (LookupIterator, error) {
+	if ds.keyBlocks == 0 {
+		dsi := &diskSegmentIterator{segment: ds, r: r, reverse: reverse}
+		dsi.fail(EndOfIterator)
+		return dsi, nil
+	}
 	var block int64 = 0
-	if lower != nil {
-		startBlock, err := binarySearch0(ds, 0, ds.keyBlocks-1, lower, buffer)
+	start := r.Lower
+	if reverse {
+		block = ds.keyBlocks - 1
+		start = r.Upper
+	}
+	if start != nil {
+		startBlock, err := binarySearch0(ds, 0, ds.keyBlocks-1, start)
 		if err != nil {
 			return nil, err
 		}
 		block = startBlock
 	}
-	n, err := ds.keyFile.ReadAt(buffer, block*keyBlockSize)
+	kb, err := ds.keyBlock(block)
 	if err != nil {
 		return nil, err
 	}
-	if n != keyBlockSize {
-		return nil, errors.New(fmt.Sprint("did not read block size ", n))
+	dsi := &diskSegmentIterator{segment: ds, r: r, kb: kb, block: block, reverse: reverse, now: nowNanos()}
+	if reverse {
+		dsi.index = len(kb.keys) - 1
 	}
-	return &diskSegmentIterator{segment: ds, lower: lower, upper: upper, buffer: buffer, block: block}, nil
+	return dsi, nil
+}
+
+func (ds *diskSegment) acquire() {
+	atomic.AddInt32(&ds.refs, 1)
+}
+
+// releases a reference, removing the segment files if it was the last reference to an obsolete segment
+func (ds *diskSegment) release() error {
+	if atomic.AddInt32(&ds.refs, -1) > 0 || atomic.LoadInt32(&ds.obsolete) == 0 {
+		return nil
+	}
+	// closing the segment removes its blocks from the cache
+	err0 := ds.Close()
+	err1 := os.Remove(ds.keyFile.Name())
+	err2 := os.Remove(ds.dataFile.Name())
+	err3 := removeBloomFilter(ds.keyFile.Name())
+	return errn(err0, err1, err2, err3)
+}
+
+// called when the segment has been replaced by a merge, releasing the reference held by the table
+func (ds *diskSegment) removeWhenReleased() error {
+	atomic.StoreInt32(&ds.obsolete, 1)
+	return ds.release()
 }
 
 func (ds *diskSegment) Close() error {
+	ds.cache.remove(ds.cacheID)
 	err0 := ds.keyFile.Close()
 	err1 := ds.dataFile.Close()
 	return errn(err0, err1)
@@ -18,7 +18,7 @@ func TestDiskSegment(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, nil, defaultSegmentOptions)
 
 	itr, err = ds.Lookup(nil, nil)
 	if err != nil {
@@ -75,7 +75,7 @@ func TestLargeDiskSegment(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, nil, defaultSegmentOptions)
 
 	itr, err = ds.Lookup(nil, nil)
 	count := 0
@@ -141,7 +141,7 @@ func TestEmptySegment(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, nil, defaultSegmentOptions)
 
 	itr, err = ds.Lookup(nil, nil)
 	count := 0
@@ -157,3 +157,124 @@ func TestEmptySegment(t *testing.T) {
 		t.Fatal("incorrect count", count)
 	}
 }
+
+func TestCorruptSegment(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	m.Put([]byte("mykey"), []byte("myvalue"))
+	m.Put([]byte("mykey2"), []byte("myvalue2"))
+	itr, err := m.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, nil, defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+
+	// corrupt the value of mykey
+	f, _ := os.OpenFile("test/datafile", os.O_WRONLY, os.ModePerm)
+	f.WriteAt([]byte("X"), 0)
+	f.Close()
+
+	ds, err = newDiskSegment("test/keyfile", "test/datafile", segmentVersion, defaultSegmentOptions, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.Get([]byte("mykey"))
+	if ce, ok := err.(*CorruptionError); !ok || !ce.Value || ce.Block != 0 {
+		t.Fatal("expected corrupt value", err)
+	}
+	_, err = ds.Get([]byte("mykey2"))
+	if err != nil {
+		t.Fatal("uncorrupted value should be readable", err)
+	}
+	ds.Close()
+
+	// corrupt the key block
+	f, _ = os.OpenFile("test/keyfile", os.O_WRONLY, os.ModePerm)
+	f.WriteAt([]byte("X"), 3)
+	f.Close()
+
+	ds, err = newDiskSegment("test/keyfile", "test/datafile", segmentVersion, defaultSegmentOptions, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.Get([]byte("mykey2"))
+	if ce, ok := err.(*CorruptionError); !ok || ce.Value || ce.Block != 0 {
+		t.Fatal("expected corrupt key block", err)
+	}
+	_, err = ds.Lookup(nil, nil)
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Fatal("expected corrupt key block", err)
+	}
+	_, err = newMultiSegment([]segment{m, ds}).Get([]byte("mykey"))
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Fatal("expected corrupt key block from multi segment", err)
+	}
+	ds.Close()
+
+	// corrupt the range tombstones, and truncate the footer
+	fi, _ := os.Stat("test/datafile")
+	corruptFile(t, "test/datafile", fi.Size()-1)
+	_, err = newDiskSegment("test/keyfile", "test/datafile", segmentVersion, defaultSegmentOptions, nil, nil)
+	if ce, ok := err.(*CorruptionError); !ok || !ce.Ranges {
+		t.Fatal("expected corrupt range tombstones", err)
+	}
+	os.Truncate("test/datafile", 4)
+	_, err = newDiskSegment("test/keyfile", "test/datafile", segmentVersion, defaultSegmentOptions, nil, nil)
+	if ce, ok := err.(*CorruptionError); !ok || !ce.Ranges {
+		t.Fatal("expected corrupt range tombstones", err)
+	}
+}
+
+func TestCorruptRangeTombstones(t *testing.T) {
+	Remove("test/mydb")
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for _, table := range []string{"a", "b"} {
+		tx, err := db.BeginTX(table)
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte("mykey"), []byte("myvalue"))
+		tx.RemoveRange([]byte("mykey1"), []byte("mykey2"))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	_, dataFilename := checkTestSegment(t, "test/mydb", "a")
+	fi, _ := os.Stat(dataFilename)
+	corruptFile(t, dataFilename, fi.Size()-1)
+
+	// only the table with the corrupt segment cannot be used
+	db, err = Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if _, err = db.BeginTX("a"); err == nil {
+		t.Fatal("expected a CorruptionError")
+	}
+	if ce, ok := err.(*CorruptionError); !ok || !ce.Ranges || ce.Table != "a" {
+		t.Fatal("expected a CorruptionError", err)
+	}
+	tx, err := db.BeginTX("b")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if value, err := tx.Get([]byte("mykey")); err != nil || string(value) != "myvalue" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
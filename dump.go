@@ -0,0 +1,693 @@
+package keydb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// DumpFormat is the file format written by Dump and read by Load
+type DumpFormat string
+
+const (
+	// DumpXML is an XML document with the keys and values encoded as text, see DumpOptions.Encoding
+	DumpXML DumpFormat = "xml"
+	// DumpBinary is a compact stream of length prefixed records
+	DumpBinary DumpFormat = "binary"
+	// DumpJSONL is a JSON object per line with the fields table, key and value, see DumpOptions.Encoding
+	DumpJSONL DumpFormat = "jsonl"
+	// DumpCSV is a header line of table,key,value and a line per key, see DumpOptions.Encoding
+	DumpCSV DumpFormat = "csv"
+)
+
+// DumpOptions controls the format of a dump, and which records are dumped or loaded
+type DumpOptions struct {
+	// Format is the file format, default DumpXML. Load detects DumpXML and DumpBinary if it is not set
+	Format DumpFormat
+	// Encoding of the keys and values in the text formats, "base64" (default), "hex" or "utf8". utf8 writes the keys
+	// and values as is, and a dump fails if one is not valid UTF-8 text that the format can hold. Load uses the
+	// encoding recorded in an XML dump
+	Encoding string
+	// Tables limits the dump or load to the named tables, default all
+	Tables []string
+	// Range limits the dump or load to the keys in the range, in the order of the Comparator of each table
+	Range Range
+	// the JSON Lines and CSV formats do not record the table counts or checksum, so they are not verified by Load
+}
+
+// returns true if the table is included by the options
+func (options DumpOptions) includes(table string) bool {
+	if options.Tables == nil {
+		return true
+	}
+	for _, t := range options.Tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// the version of the dump formats written
+const dumpVersion = 2
+
+// the binary format is
+// magic [8]byte (dumpMagic)
+// version uint8
+// and a sequence of records of
+// type uint8
+// a dumpTable record starts a table
+// namelen uint16
+// name []byte
+// a dumpEntry record is a key/value of the table
+// keylen uint16
+// key []byte
+// valuelen uint32
+// value []byte
+// a dumpEnd record ends the table
+// count uint64 (the number of entries in the table)
+// a dumpTrailer record ends the dump
+// checksum uint32 (see dumpChecksum)
+//
+// the XML format is a db element with the attributes path, version and encoding, holding for each table
+// <tabledata name="..."> (the entries and count of the table) </tabledata>
+// where each entry is
+// <entry><key>...</key><value>...</value></entry>
+// and the count is
+// <count>...</count>
+// and the tables are followed by
+// <checksum>...</checksum> (hex)
+// a dump without a version is from an older dbdump, with the keys and values as escaped text, or as hex if the db
+// element has the attribute strings="false"
+const dumpMagic = "KEYDBDMP"
+
+const (
+	dumpTable   uint8 = 1
+	dumpEntry   uint8 = 2
+	dumpEnd     uint8 = 3
+	dumpTrailer uint8 = 4
+)
+
+var errCorruptDump = errors.New("corrupt dump")
+
+// dumpChecksum is the CRC32C of the tables and entries of a dump in their binary record encoding, so a dump
+// converted between formats keeps its checksum
+type dumpChecksum struct {
+	h   hash.Hash32
+	buf [4]byte
+}
+
+func newDumpChecksum() *dumpChecksum {
+	return &dumpChecksum{h: crc32.New(crcTable)}
+}
+
+func (dc *dumpChecksum) table(name string) {
+	binary.LittleEndian.PutUint16(dc.buf[:], uint16(len(name)))
+	dc.h.Write(dc.buf[:2])
+	dc.h.Write([]byte(name))
+}
+
+func (dc *dumpChecksum) entry(key, value []byte) {
+	binary.LittleEndian.PutUint16(dc.buf[:], uint16(len(key)))
+	dc.h.Write(dc.buf[:2])
+	dc.h.Write(key)
+	binary.LittleEndian.PutUint32(dc.buf[:], uint32(len(value)))
+	dc.h.Write(dc.buf[:4])
+	dc.h.Write(value)
+}
+
+func (dc *dumpChecksum) sum() uint32 {
+	return dc.h.Sum32()
+}
+
+// dumpWriter writes a dump in one of the formats
+type dumpWriter interface {
+	beginTable(name string) error
+	entry(key, value []byte) error
+	endTable(count uint64) error
+	// ends the dump
+	close(checksum uint32) error
+}
+
+// a record read from a dump, see dumpReader
+type dumpRecord struct {
+	kind     uint8 // dumpTable, dumpEntry, dumpEnd or dumpTrailer
+	table    string
+	key      []byte
+	value    []byte
+	count    uint64
+	checksum uint32
+	// false if the dump does not record the count or checksum
+	verify bool
+}
+
+// dumpReader reads the records of a dump, the last is a dumpTrailer. a dump that ends before the trailer is corrupt
+type dumpReader interface {
+	next() (dumpRecord, error)
+}
+
+// Dump writes the tables of the database to w. each table is read from a snapshot as of the start of its dump, see
+// BeginReadTX, so the database can be written during a dump
+func (db *Database) Dump(w io.Writer, options DumpOptions) error {
+	all, err := db.ListTables()
+	if err != nil {
+		return err
+	}
+	tables := all
+	if options.Tables != nil {
+		exists := make(map[string]bool)
+		for _, table := range all {
+			exists[table] = true
+		}
+		tables = nil
+		for _, table := range options.Tables {
+			if !exists[table] {
+				return TableNotFound
+			}
+			tables = append(tables, table)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	dw, err := newDumpWriter(bw, db.path, options)
+	if err != nil {
+		return err
+	}
+	checksum := newDumpChecksum()
+
+	for _, table := range tables {
+		if err := db.dumpTable(dw, checksum, table, options.Range); err != nil {
+			return err
+		}
+	}
+	if err := dw.close(checksum.sum()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (db *Database) dumpTable(dw dumpWriter, checksum *dumpChecksum, table string, r Range) error {
+	tx, err := db.BeginReadTX(table)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	itr, err := tx.LookupRange(r)
+	if err != nil {
+		return err
+	}
+	if err := dw.beginTable(table); err != nil {
+		return err
+	}
+	checksum.table(table)
+
+	var count uint64
+	for {
+		key, value, err := itr.Next()
+		if err == EndOfIterator {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := dw.entry(key, value); err != nil {
+			return err
+		}
+		checksum.entry(key, value)
+		count++
+	}
+	return dw.endTable(count)
+}
+
+// Load puts the entries of a dump written by Dump into the database, replacing the values of existing keys. each
+// table is committed once all of its entries have been read and its count verified, and an error is returned if
+// the checksum at the end of the dump does not match, which may be after some tables have been committed. the
+// entries of the tables and keys not included by the options are skipped
+func (db *Database) Load(r io.Reader, options DumpOptions) error {
+	br := bufio.NewReader(r)
+	dr, err := newDumpReader(br, options)
+	if err != nil {
+		return err
+	}
+	checksum := newDumpChecksum()
+
+	var tx *Transaction
+	var count uint64
+	// in a table that is not loaded
+	var skipping bool
+	var cmp Comparator
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+
+	for {
+		rec, err := dr.next()
+		if err != nil {
+			return err
+		}
+		switch rec.kind {
+		case dumpTable:
+			if tx != nil || skipping {
+				return errCorruptDump
+			}
+			checksum.table(rec.table)
+			count = 0
+			if !options.includes(rec.table) {
+				skipping = true
+				continue
+			}
+			tx, err = db.BeginTX(rec.table)
+			if err != nil {
+				return err
+			}
+			cmp = db.options.forTable(rec.table).comparator
+		case dumpEntry:
+			if tx == nil && !skipping {
+				return errCorruptDump
+			}
+			checksum.entry(rec.key, rec.value)
+			count++
+			if skipping || !options.Range.contains(cmp, rec.key) {
+				continue
+			}
+			if err := tx.Put(rec.key, rec.value); err != nil {
+				return err
+			}
+		case dumpEnd:
+			if tx == nil && !skipping {
+				return errCorruptDump
+			}
+			if rec.verify && rec.count != count {
+				return errors.New(fmt.Sprint("a table has ", count, " entries in the dump, expected ", rec.count))
+			}
+			if skipping {
+				skipping = false
+				continue
+			}
+			err := tx.Commit()
+			tx = nil
+			if err != nil {
+				return err
+			}
+		case dumpTrailer:
+			if tx != nil || skipping {
+				return errCorruptDump
+			}
+			if rec.verify && rec.checksum != checksum.sum() {
+				return errors.New("dump checksum does not match, the dump is corrupt or truncated")
+			}
+			return nil
+		}
+	}
+}
+
+func newDumpWriter(w *bufio.Writer, path string, options DumpOptions) (dumpWriter, error) {
+	if options.Encoding == "" {
+		options.Encoding = "base64"
+	}
+	switch options.Format {
+	case DumpXML, "":
+		encode, err := dumpEncoder(options.Encoding, isXMLChar)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(w, "<db path=\"%s\" version=\"%d\" encoding=\"%s\">\n", escapeXML(path), dumpVersion, options.Encoding)
+		return &xmlDumpWriter{w: w, encode: encode}, nil
+	case DumpBinary:
+		w.WriteString(dumpMagic)
+		w.WriteByte(dumpVersion)
+		return &binaryDumpWriter{w: w}, nil
+	case DumpJSONL:
+		encode, err := dumpEncoder(options.Encoding, nil)
+		if err != nil {
+			return nil, err
+		}
+		return newJSONLDumpWriter(w, encode), nil
+	case DumpCSV:
+		// a carriage return in a quoted field is read back as part of a line ending
+		encode, err := dumpEncoder(options.Encoding, func(r rune) bool { return r != '\r' })
+		if err != nil {
+			return nil, err
+		}
+		return newCSVDumpWriter(w, encode)
+	}
+	return nil, errors.New(fmt.Sprint("unsupported dump format ", options.Format))
+}
+
+func newDumpReader(r *bufio.Reader, options DumpOptions) (dumpReader, error) {
+	format := options.Format
+	if format == "" {
+		magic, _ := r.Peek(len(dumpMagic))
+		if string(magic) == dumpMagic {
+			format = DumpBinary
+		} else {
+			format = DumpXML
+		}
+	}
+	switch format {
+	case DumpXML:
+		return &xmlDumpReader{decoder: xml.NewDecoder(r)}, nil
+	case DumpBinary:
+		header := make([]byte, len(dumpMagic)+1)
+		if _, err := io.ReadFull(r, header); err != nil || string(header[:len(dumpMagic)]) != dumpMagic {
+			return nil, errCorruptDump
+		}
+		if header[len(dumpMagic)] != dumpVersion {
+			return nil, errors.New(fmt.Sprint("unsupported dump version ", header[len(dumpMagic)]))
+		}
+		return &binaryDumpReader{r: r}, nil
+	case DumpJSONL, DumpCSV:
+		encoding := options.Encoding
+		if encoding == "" {
+			encoding = "base64"
+		}
+		decode, err := dumpDecoder(encoding)
+		if err != nil {
+			return nil, err
+		}
+		if format == DumpJSONL {
+			return newJSONLDumpReader(r, decode), nil
+		}
+		return newCSVDumpReader(r, decode), nil
+	}
+	return nil, errors.New(fmt.Sprint("unsupported dump format ", format))
+}
+
+// returns the function that encodes the keys and values of a text dump. with utf8 the keys and values must be valid
+// UTF-8, and every rune must be valid in the format, which is any rune if valid is nil
+func dumpEncoder(encoding string, valid func(rune) bool) (func([]byte) (string, error), error) {
+	switch encoding {
+	case "base64":
+		return func(b []byte) (string, error) { return base64.StdEncoding.EncodeToString(b), nil }, nil
+	case "hex":
+		return func(b []byte) (string, error) { return hex.EncodeToString(b), nil }, nil
+	case "utf8":
+		return func(b []byte) (string, error) {
+			if !utf8.Valid(b) {
+				return "", errors.New(fmt.Sprintf("%q is not valid utf8, use the hex or base64 encoding", b))
+			}
+			s := string(b)
+			for _, r := range s {
+				if valid != nil && !valid(r) {
+					return "", errors.New(fmt.Sprintf("%q cannot be held as text in the format, use the hex or base64 encoding", b))
+				}
+			}
+			return s, nil
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprint("unsupported dump encoding ", encoding))
+}
+
+// DecodeDumpKey decodes a key in a dump encoding, base64, hex or utf8, such as a bound of DumpOptions.Range given as
+// text. an empty string is an unbounded key, and returns nil
+func DecodeDumpKey(encoding string, s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	decode, err := dumpDecoder(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return decode(s)
+}
+
+// returns the function that decodes the keys and values of a text dump
+func dumpDecoder(encoding string) (func(string) ([]byte, error), error) {
+	switch encoding {
+	case "base64":
+		return base64.StdEncoding.DecodeString, nil
+	case "hex":
+		return hex.DecodeString, nil
+	case "utf8":
+		return func(s string) ([]byte, error) { return []byte(s), nil }, nil
+	}
+	return nil, errors.New(fmt.Sprint("unsupported dump encoding ", encoding))
+}
+
+// returns true if the rune is a character allowed in XML text
+func isXMLChar(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D || (r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || (r >= 0x10000 && r <= 0x10FFFF)
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+type xmlDumpWriter struct {
+	w      *bufio.Writer
+	encode func([]byte) (string, error)
+}
+
+func (xw *xmlDumpWriter) beginTable(name string) error {
+	_, err := fmt.Fprintf(xw.w, "\t<tabledata name=\"%s\">\n", escapeXML(name))
+	return err
+}
+
+func (xw *xmlDumpWriter) entry(key, value []byte) error {
+	k, err0 := xw.encode(key)
+	v, err1 := xw.encode(value)
+	if err := errn(err0, err1); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(xw.w, "\t\t<entry><key>%s</key><value>%s</value></entry>\n", escapeXML(k), escapeXML(v))
+	return err
+}
+
+func (xw *xmlDumpWriter) endTable(count uint64) error {
+	_, err := fmt.Fprintf(xw.w, "\t\t<count>%d</count>\n\t</tabledata>\n", count)
+	return err
+}
+
+func (xw *xmlDumpWriter) close(checksum uint32) error {
+	_, err := fmt.Fprintf(xw.w, "\t<checksum>%08x</checksum>\n</db>\n", checksum)
+	return err
+}
+
+type xmlDumpReader struct {
+	decoder *xml.Decoder
+	decode  func(string) ([]byte, error)
+	// the dump has a version, so records the table counts and checksum
+	versioned bool
+	// a count element was read for the current table
+	counted bool
+	count   uint64
+}
+
+func (xr *xmlDumpReader) next() (dumpRecord, error) {
+	for {
+		t, err := xr.decoder.Token()
+		if err == io.EOF {
+			return dumpRecord{}, errCorruptDump
+		}
+		if err != nil {
+			return dumpRecord{}, err
+		}
+		switch se := t.(type) {
+		case xml.StartElement:
+			switch se.Name.Local {
+			case "db":
+				if err := xr.header(se.Attr); err != nil {
+					return dumpRecord{}, err
+				}
+			case "tabledata":
+				xr.counted = false
+				return dumpRecord{kind: dumpTable, table: xmlAttr("name", se.Attr)}, nil
+			case "entry":
+				var e struct {
+					Key   string `xml:"key"`
+					Value string `xml:"value"`
+				}
+				if err := xr.decoder.DecodeElement(&e, &se); err != nil {
+					return dumpRecord{}, err
+				}
+				key, err0 := xr.decode(e.Key)
+				value, err1 := xr.decode(e.Value)
+				if err0 != nil || err1 != nil {
+					return dumpRecord{}, errCorruptDump
+				}
+				return dumpRecord{kind: dumpEntry, key: key, value: value}, nil
+			case "count":
+				var s string
+				if err := xr.decoder.DecodeElement(&s, &se); err != nil {
+					return dumpRecord{}, err
+				}
+				if xr.count, err = strconv.ParseUint(s, 10, 64); err != nil {
+					return dumpRecord{}, errCorruptDump
+				}
+				xr.counted = true
+			case "checksum":
+				var s string
+				if err := xr.decoder.DecodeElement(&s, &se); err != nil {
+					return dumpRecord{}, err
+				}
+				checksum, err := strconv.ParseUint(s, 16, 32)
+				if err != nil {
+					return dumpRecord{}, errCorruptDump
+				}
+				return dumpRecord{kind: dumpTrailer, checksum: uint32(checksum), verify: true}, nil
+			}
+		case xml.EndElement:
+			switch se.Name.Local {
+			case "tabledata":
+				if xr.versioned && !xr.counted {
+					return dumpRecord{}, errCorruptDump
+				}
+				return dumpRecord{kind: dumpEnd, count: xr.count, verify: xr.counted}, nil
+			case "db":
+				if xr.versioned {
+					// the checksum is missing, so the dump was truncated
+					return dumpRecord{}, errCorruptDump
+				}
+				return dumpRecord{kind: dumpTrailer}, nil
+			}
+		}
+	}
+}
+
+// reads the attributes of the db element
+func (xr *xmlDumpReader) header(attrs []xml.Attr) error {
+	encoding := xmlAttr("encoding", attrs)
+	if version := xmlAttr("version", attrs); version != "" {
+		if version != strconv.Itoa(dumpVersion) {
+			return errors.New("unsupported dump version " + version)
+		}
+		xr.versioned = true
+	} else if asStrings, err := strconv.ParseBool(xmlAttr("strings", attrs)); err == nil && !asStrings {
+		encoding = "hex"
+	} else {
+		encoding = "utf8"
+	}
+	decode, err := dumpDecoder(encoding)
+	if err != nil {
+		return err
+	}
+	xr.decode = decode
+	return nil
+}
+
+func xmlAttr(name string, attrs []xml.Attr) string {
+	for _, v := range attrs {
+		if v.Name.Local == name {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+type binaryDumpWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+}
+
+func (bw *binaryDumpWriter) beginTable(name string) error {
+	bw.w.WriteByte(dumpTable)
+	binary.LittleEndian.PutUint16(bw.buf[:], uint16(len(name)))
+	bw.w.Write(bw.buf[:2])
+	_, err := bw.w.WriteString(name)
+	return err
+}
+
+func (bw *binaryDumpWriter) entry(key, value []byte) error {
+	bw.w.WriteByte(dumpEntry)
+	binary.LittleEndian.PutUint16(bw.buf[:], uint16(len(key)))
+	bw.w.Write(bw.buf[:2])
+	bw.w.Write(key)
+	binary.LittleEndian.PutUint32(bw.buf[:], uint32(len(value)))
+	bw.w.Write(bw.buf[:4])
+	_, err := bw.w.Write(value)
+	return err
+}
+
+func (bw *binaryDumpWriter) endTable(count uint64) error {
+	bw.w.WriteByte(dumpEnd)
+	binary.LittleEndian.PutUint64(bw.buf[:], count)
+	_, err := bw.w.Write(bw.buf[:8])
+	return err
+}
+
+func (bw *binaryDumpWriter) close(checksum uint32) error {
+	bw.w.WriteByte(dumpTrailer)
+	binary.LittleEndian.PutUint32(bw.buf[:], checksum)
+	_, err := bw.w.Write(bw.buf[:4])
+	return err
+}
+
+type binaryDumpReader struct {
+	r *bufio.Reader
+}
+
+// reads n bytes, a dump that ends part way through a record is corrupt. the buffer grows as it is read, so a corrupt
+// length does not allocate more than the rest of the dump
+func (br *binaryDumpReader) read(n int) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	if _, err := io.CopyN(buf, br.r, int64(n)); err != nil {
+		return nil, errCorruptDump
+	}
+	// an empty value is not nil, which would remove the key
+	return buf.Bytes(), nil
+}
+
+func (br *binaryDumpReader) next() (dumpRecord, error) {
+	kind, err := br.r.ReadByte()
+	if err != nil {
+		// the trailer is missing, so the dump was truncated
+		return dumpRecord{}, errCorruptDump
+	}
+	rec := dumpRecord{kind: kind, verify: true}
+	switch kind {
+	case dumpTable:
+		buf, err := br.read(2)
+		if err != nil {
+			return rec, err
+		}
+		name, err := br.read(int(binary.LittleEndian.Uint16(buf)))
+		if err != nil {
+			return rec, err
+		}
+		rec.table = string(name)
+	case dumpEntry:
+		buf, err := br.read(2)
+		if err != nil {
+			return rec, err
+		}
+		if rec.key, err = br.read(int(binary.LittleEndian.Uint16(buf))); err != nil {
+			return rec, err
+		}
+		if buf, err = br.read(4); err != nil {
+			return rec, err
+		}
+		if rec.value, err = br.read(int(binary.LittleEndian.Uint32(buf))); err != nil {
+			return rec, err
+		}
+	case dumpEnd:
+		buf, err := br.read(8)
+		if err != nil {
+			return rec, err
+		}
+		rec.count = binary.LittleEndian.Uint64(buf)
+	case dumpTrailer:
+		buf, err := br.read(4)
+		if err != nil {
+			return rec, err
+		}
+		rec.checksum = binary.LittleEndian.Uint32(buf)
+	default:
+		return rec, errCorruptDump
+	}
+	return rec, nil
+}
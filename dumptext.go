@@ -0,0 +1,150 @@
+package keydb
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// the JSON Lines and CSV dumps are a row per key with the table, key and value, which can be read by other tools.
+// the rows of a table are contiguous, and the records of a table start and end where the table of the rows changes
+
+// a row of a text dump
+type dumpRow struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// textDumpWriter writes the rows of a text dump
+type textDumpWriter struct {
+	table  string
+	encode func([]byte) (string, error)
+	write  func(row dumpRow) error
+	flush  func() error
+}
+
+func (tw *textDumpWriter) beginTable(name string) error {
+	tw.table = name
+	return nil
+}
+
+func (tw *textDumpWriter) entry(key, value []byte) error {
+	k, err0 := tw.encode(key)
+	v, err1 := tw.encode(value)
+	if err := errn(err0, err1); err != nil {
+		return err
+	}
+	return tw.write(dumpRow{Table: tw.table, Key: k, Value: v})
+}
+
+func (tw *textDumpWriter) endTable(count uint64) error {
+	return nil
+}
+
+func (tw *textDumpWriter) close(checksum uint32) error {
+	return tw.flush()
+}
+
+func newJSONLDumpWriter(w *bufio.Writer, encode func([]byte) (string, error)) dumpWriter {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return &textDumpWriter{
+		encode: encode,
+		write:  func(row dumpRow) error { return encoder.Encode(row) },
+		flush:  func() error { return nil }}
+}
+
+func newCSVDumpWriter(w *bufio.Writer, encode func([]byte) (string, error)) (dumpWriter, error) {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"table", "key", "value"}); err != nil {
+		return nil, err
+	}
+	return &textDumpWriter{
+		encode: encode,
+		write:  func(row dumpRow) error { return cw.Write([]string{row.Table, row.Key, row.Value}) },
+		flush: func() error {
+			cw.Flush()
+			return cw.Error()
+		}}, nil
+}
+
+// textDumpReader reads the rows of a text dump as the records of a dump
+type textDumpReader struct {
+	decode func(string) ([]byte, error)
+	// returns the next row, or io.EOF
+	read func() (dumpRow, error)
+	// the table of the previous row
+	table string
+	open  bool
+	// the records read but not yet returned
+	pending []dumpRecord
+	done    bool
+}
+
+func (tr *textDumpReader) next() (dumpRecord, error) {
+	for len(tr.pending) == 0 {
+		if tr.done {
+			return dumpRecord{}, errCorruptDump
+		}
+		row, err := tr.read()
+		if err == io.EOF {
+			if tr.open {
+				tr.pending = append(tr.pending, dumpRecord{kind: dumpEnd})
+			}
+			tr.pending = append(tr.pending, dumpRecord{kind: dumpTrailer})
+			tr.done = true
+			continue
+		}
+		if err != nil {
+			return dumpRecord{}, err
+		}
+		key, err0 := tr.decode(row.Key)
+		value, err1 := tr.decode(row.Value)
+		if err0 != nil || err1 != nil {
+			return dumpRecord{}, errCorruptDump
+		}
+		if !tr.open || row.Table != tr.table {
+			if tr.open {
+				tr.pending = append(tr.pending, dumpRecord{kind: dumpEnd})
+			}
+			tr.pending = append(tr.pending, dumpRecord{kind: dumpTable, table: row.Table})
+			tr.table, tr.open = row.Table, true
+		}
+		tr.pending = append(tr.pending, dumpRecord{kind: dumpEntry, key: key, value: value})
+	}
+	rec := tr.pending[0]
+	tr.pending = tr.pending[1:]
+	return rec, nil
+}
+
+func newJSONLDumpReader(r *bufio.Reader, decode func(string) ([]byte, error)) dumpReader {
+	decoder := json.NewDecoder(r)
+	return &textDumpReader{decode: decode, read: func() (dumpRow, error) {
+		var row dumpRow
+		err := decoder.Decode(&row)
+		return row, err
+	}}
+}
+
+func newCSVDumpReader(r *bufio.Reader, decode func(string) ([]byte, error)) dumpReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	header := true
+	return &textDumpReader{decode: decode, read: func() (dumpRow, error) {
+		fields, err := cr.Read()
+		if err == nil && header {
+			header = false
+			if fields[0] != "table" || fields[1] != "key" || fields[2] != "value" {
+				return dumpRow{}, errors.New("a csv dump must start with the header table,key,value")
+			}
+			fields, err = cr.Read()
+		}
+		if err != nil {
+			return dumpRow{}, err
+		}
+		return dumpRow{Table: fields[0], Key: fields[1], Value: fields[2]}, nil
+	}}
+}
@@ -1,6 +1,9 @@
 package keydb
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var KeyNotFound = errors.New("key not found")
 var KeyTooLong = errors.New("key too long, max 1024")
@@ -14,6 +17,66 @@ var NotADirectory = errors.New("path is not a directory")
 var NotValidDatabase = errors.New("path is not a valid database")
 var EndOfIterator = errors.New("end of iterator")
 var ReadOnlySegment = errors.New("read only segment")
+var ReadOnlyTransaction = errors.New("read only transaction")
+var PartOfMultiTransaction = errors.New("transaction is part of a multi table transaction")
+var TableNotInTransaction = errors.New("table is not part of the transaction")
+var TableNotFound = errors.New("table not found")
+var TableExists = errors.New("table already exists")
+var InvalidTableName = errors.New("invalid table name")
+var NoMergeOperator = errors.New("table has no merge operator")
+var InvalidTTL = errors.New("ttl must be positive")
+var PrefixRequiresBytewise = errors.New("prefix lookups require a table ordered by BytewiseComparator")
+var InvalidBackup = errors.New("not a valid backup")
+var BrokenBackupChain = errors.New("backups are not a chain starting with a full backup")
+
+// CorruptionError is returned when data read from a segment does not match its checksum
+type CorruptionError struct {
+	Table     string
+	SegmentID uint64
+	// the key block that is corrupt, or that holds the key of a corrupt value
+	Block int64
+	// true if the value is corrupt, at Offset in the data file
+	Value  bool
+	Offset int64
+	// true if the range tombstones at the end of the data file are corrupt, Block is -1
+	Ranges bool
+}
+
+func (e *CorruptionError) Error() string {
+	if e.Ranges {
+		return fmt.Sprint("corrupt range tombstones of segment ", e.SegmentID, " in table ", e.Table)
+	}
+	if e.Value {
+		return fmt.Sprint("corrupt value at offset ", e.Offset, " for key block ", e.Block, " of segment ", e.SegmentID, " in table ", e.Table)
+	}
+	return fmt.Sprint("corrupt key block ", e.Block, " of segment ", e.SegmentID, " in table ", e.Table)
+}
+
+// ConflictError is returned by Commit when the transaction conflicts with a transaction that committed after it
+// began, see Isolation. the transaction is rolled back
+type ConflictError struct {
+	Table string
+	// the key written by the other transaction
+	Key []byte
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("transaction conflict on key %q in table %s", e.Key, e.Table)
+}
+
+// ComparatorError is returned when a transaction is started on a table, and the database was opened with a
+// Comparator for the table other than the one it was created with. the other tables can still be used
+type ComparatorError struct {
+	Table string
+	// the name of the comparator the table was created with
+	Expected string
+	// the name of the comparator in the options
+	Actual string
+}
+
+func (e *ComparatorError) Error() string {
+	return fmt.Sprint("table ", e.Table, " uses comparator ", e.Expected, ", not ", e.Actual)
+}
 
 // returns the first non-nil error
 func errn(errs ...error) error {
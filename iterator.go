@@ -0,0 +1,184 @@
+package keydb
+
+// Iterator is a positionable iterator over a range of a table. it is created unpositioned, and is positioned with
+// First, Last or Seek. it can be repositioned any number of times, and moved in either direction with Next and Prev.
+// removed keys are skipped. the disk segments read by the iterator are kept until Close is called, so every Iterator
+// should be closed, but it does not need to be read until completion
+type Iterator struct {
+	tx         *Transaction
+	multi      *multiSegment
+	r          Range
+	itr        LookupIterator
+	reverse    bool // itr returns descending keys
+	key, value []byte
+	valid      bool
+	err        error
+	pinned     []*diskSegment
+	closed     bool
+}
+
+// NewIterator returns an Iterator for the records between lower and upper inclusive. lower or upper can be nil
+// and then the range is unbounded on that side. using the iterator after the transaction has been Commit/Rollback
+// is not supported
+func (tx *Transaction) NewIterator(lower []byte, upper []byte) (*Iterator, error) {
+	return tx.NewRangeIterator(Range{Lower: lower, Upper: upper})
+}
+
+// NewRangeIterator returns an Iterator for the records in the range, see NewIterator
+func (tx *Transaction) NewRangeIterator(r Range) (*Iterator, error) {
+	if !tx.open {
+		return nil, TransactionClosed
+	}
+	if tx.reads != nil {
+		tx.reads.addRange(r.Lower, r.Upper)
+	}
+	it := &Iterator{tx: tx, multi: tx.multi, r: r}
+	for _, s := range tx.multi.segments {
+		if ds, ok := s.(*diskSegment); ok {
+			ds.acquire()
+			it.pinned = append(it.pinned, ds)
+		}
+	}
+	return it, nil
+}
+
+// First positions the iterator at the first record in the range, returning false if there is none
+func (it *Iterator) First() bool {
+	return it.seek(nil, false)
+}
+
+// Last positions the iterator at the last record in the range, returning false if there is none
+func (it *Iterator) Last() bool {
+	return it.seek(nil, true)
+}
+
+// Seek positions the iterator at the first record with a key greater than or equal to key, returning false if
+// there is none in the range
+func (it *Iterator) Seek(key []byte) bool {
+	return it.seek(key, false)
+}
+
+// SeekForPrev positions the iterator at the last record with a key less than or equal to key, returning false if
+// there is none in the range
+func (it *Iterator) SeekForPrev(key []byte) bool {
+	return it.seek(key, true)
+}
+
+// Next moves the iterator to the next record, returning false if there is none
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	if it.reverse {
+		// change direction, starting from the current key
+		key := it.key
+		return it.seek(key, false) && (!equalKeys(it.multi.cmp, it.key, key) || it.advance())
+	}
+	return it.advance()
+}
+
+// Prev moves the iterator to the previous record, returning false if there is none
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	if !it.reverse {
+		key := it.key
+		return it.seek(key, true) && (!equalKeys(it.multi.cmp, it.key, key) || it.advance())
+	}
+	return it.advance()
+}
+
+// Valid returns true if the iterator is positioned at a record
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key of the current record, the key must not be modified
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the current record
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the resources held by the iterator. the iterator can no longer be used
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.valid = false
+	it.itr = nil
+	it.multi = nil
+	it.key, it.value = nil, nil
+
+	var errs []error
+	for _, ds := range it.pinned {
+		errs = append(errs, ds.release())
+	}
+	it.pinned = nil
+	return errn(errs...)
+}
+
+// starts an iteration from key, ascending or descending. a nil key starts from the first or last key of the range
+func (it *Iterator) seek(key []byte, reverse bool) bool {
+	it.valid = false
+	it.key, it.value = nil, nil
+	if it.closed {
+		it.err = TransactionClosed
+		return false
+	}
+	if !it.tx.open {
+		it.err = TransactionClosed
+		return false
+	}
+	// the key is outside of the range
+	cmp := it.multi.cmp
+	if key != nil && ((!reverse && it.r.after(cmp, key)) || (reverse && it.r.before(cmp, key))) {
+		return false
+	}
+
+	var err error
+	if reverse {
+		it.itr, err = it.multi.LookupRange(it.r.to(cmp, key), true)
+	} else {
+		it.itr, err = it.multi.LookupRange(it.r.from(cmp, key), false)
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.reverse = reverse
+	return it.advance()
+}
+
+// moves to the next record in the direction of the iteration, skipping removed records
+func (it *Iterator) advance() bool {
+	for {
+		key, value, err := it.itr.Next()
+		if err == EndOfIterator {
+			it.valid = false
+			it.key, it.value = nil, nil
+			return false
+		}
+		if err != nil {
+			it.err = err
+			it.valid = false
+			it.key, it.value = nil, nil
+			return false
+		}
+		if value == nil {
+			continue
+		}
+		it.key, it.value, it.valid = key, value, true
+		return true
+	}
+}
@@ -0,0 +1,481 @@
+package keydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the MANIFEST records the live segments of every table, so the segments that make up a table are never inferred from
+// the directory listing. it is an append-only sequence of length/crc framed records (see wal.go), each record is an
+// edit which is applied atomically
+//
+// type uint8 (manifestEdit)
+// count uint32
+// and count changes of
+// op uint8 (addSegment, removeSegment, setComparator, dropTable or setMaxSegmentID)
+// tablelen uint16
+// table []byte
+// keyfilelen uint16
+// keyfile []byte (for setComparator the name of the comparator, empty for dropTable and setMaxSegmentID)
+// and for addSegment
+// datafilelen uint16
+// datafile []byte
+// low uint64
+// id uint64
+// version uint8 (the segment format version)
+// blocksize uint32 (the key block size)
+// and for setMaxSegmentID
+// id uint64
+//
+// a segment is identified by its key file name, since a merged segment has the same id as the newest segment it
+// replaces. segment ids are never reused, even once the segments with the highest ids are dropped or purged, so the
+// manifest also records the highest id of any segment it has held, or that was allocated before a backup. the
+// manifest is rewritten as a single edit every time the database is opened. a table without a comparator was created
+// before comparators were recorded, and uses BytewiseComparator
+const manifestFilename = "MANIFEST"
+
+const manifestEdit uint8 = 1
+
+const (
+	addSegment      uint8 = 1
+	removeSegment   uint8 = 2
+	setComparator   uint8 = 3
+	dropTable       uint8 = 4 // removes the comparator, the segments are removed by removeSegment changes
+	setMaxSegmentID uint8 = 5 // raises the highest segment id allocated
+)
+
+var errCorruptManifest = errors.New("corrupt manifest")
+
+// segmentInfo describes a live disk segment. file names are relative to the database directory
+type segmentInfo struct {
+	keyFile   string
+	dataFile  string
+	low       uint64
+	id        uint64
+	version   uint8
+	blockSize int
+}
+
+type manifestChange struct {
+	op         uint8
+	table      string
+	info       segmentInfo
+	comparator string // the comparator name for setComparator
+}
+
+type manifest struct {
+	sync.Mutex
+	path        string
+	file        *os.File
+	tables      map[string][]segmentInfo // live segments in id order
+	comparators map[string]string        // the comparator name of each table
+	maxID       uint64                   // the highest segment id allocated, see maxSegmentID
+}
+
+// opens the manifest in the database directory, creating it from the segment files if the database was written by a
+// version without a manifest. segment files that are not in the manifest are removed, returning a description of the
+// removals
+func openManifest(dbpath string) (*manifest, []string, error) {
+	m := &manifest{path: dbpath, tables: make(map[string][]segmentInfo), comparators: make(map[string]string)}
+
+	var report []string
+
+	f, err := os.Open(filepath.Join(dbpath, manifestFilename))
+	if err == nil {
+		err = m.read(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if os.IsNotExist(err) {
+		report, err = recoverLegacySegments(dbpath)
+		if err != nil {
+			return nil, report, err
+		}
+		err = m.importDirectory()
+		if err != nil {
+			return nil, report, err
+		}
+	} else {
+		return nil, nil, err
+	}
+
+	removed, err := m.removeUnreferenced()
+	report = append(report, removed...)
+	if err != nil {
+		return nil, report, err
+	}
+
+	return m, report, m.rewrite()
+}
+
+func (m *manifest) read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		payload, err := readLogRecord(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptLog {
+			// an edit that was not completely written was never applied
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		changes, err := decodeManifestEdit(payload)
+		if err != nil {
+			return err
+		}
+		m.applyChanges(changes)
+	}
+}
+
+// builds the manifest from the segment files in the directory. these were written before segments were versioned
+func (m *manifest) importDirectory() error {
+	infos, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return err
+	}
+	for _, f := range infos {
+		name := f.Name()
+		if strings.HasSuffix(name, ".tmp") || strings.Index(name, ".keys.") < 0 {
+			continue
+		}
+		low, id := getSegmentRange(name)
+		info := segmentInfo{keyFile: name, dataFile: replaceLast(name, ".keys.", ".data."), low: low, id: id, blockSize: defaultKeyBlockSize}
+		table := getTableName(name)
+		m.tables[table] = append(m.tables[table], info)
+	}
+	for _, segments := range m.tables {
+		sort.SliceStable(segments, func(i, j int) bool {
+			return segments[i].id < segments[j].id
+		})
+	}
+	return nil
+}
+
+// removes the segment files left by a segment write or merge that did not complete, and ensures every
+// segment in the manifest exists. bloom filters are optional, so a missing filter is not an error
+func (m *manifest) removeUnreferenced() ([]string, error) {
+	referenced := make(map[string]bool)
+	for table, segments := range m.tables {
+		for _, info := range segments {
+			for _, name := range []string{info.keyFile, info.dataFile} {
+				if _, err := os.Stat(filepath.Join(m.path, name)); err != nil {
+					return nil, errors.New(fmt.Sprint("table ", table, " is missing segment file ", name))
+				}
+				referenced[name] = true
+			}
+			referenced[bloomFilename(info.keyFile)] = true
+		}
+	}
+
+	infos, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []string
+	for _, f := range infos {
+		name := f.Name()
+		if strings.Index(name, ".keys.") < 0 && strings.Index(name, ".data.") < 0 && !isBloomFile(name) {
+			continue
+		}
+		if referenced[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(m.path, name)); err != nil {
+			return report, err
+		}
+		report = append(report, fmt.Sprint("removed segment file ", name, " which is not in the manifest"))
+	}
+	return report, nil
+}
+
+// returns a single edit that creates the comparators and live segments
+func (m *manifest) edit() []manifestChange {
+	var changes []manifestChange
+	for table, name := range m.comparators {
+		changes = append(changes, manifestChange{op: setComparator, table: table, comparator: name})
+	}
+	for table, segments := range m.tables {
+		for _, info := range segments {
+			changes = append(changes, manifestChange{op: addSegment, table: table, info: info})
+		}
+	}
+	if m.maxID > 0 {
+		changes = append(changes, manifestChange{op: setMaxSegmentID, info: segmentInfo{id: m.maxID}})
+	}
+	return changes
+}
+
+// replaces the manifest with a single edit of the live segments, and opens it for appending
+func (m *manifest) rewrite() error {
+	changes := m.edit()
+
+	filename := filepath.Join(m.path, manifestFilename)
+
+	f, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err0 := f.Write(encodeLogRecord(encodeManifestEdit(changes)))
+	err1 := f.Sync()
+	err2 := f.Close()
+	if err := errn(err0, err1, err2); err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return err
+	}
+	if err := syncDir(m.path); err != nil {
+		return err
+	}
+
+	m.file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, os.ModePerm)
+	return err
+}
+
+// atomically records the changes, syncing the manifest if sync is true
+func (m *manifest) apply(changes []manifestChange, sync bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, err := m.file.Write(encodeLogRecord(encodeManifestEdit(changes))); err != nil {
+		return err
+	}
+	if sync {
+		if err := m.file.Sync(); err != nil {
+			return err
+		}
+	}
+	m.applyChanges(changes)
+	return nil
+}
+
+// removals are applied before additions, so a merge can replace segments with the same id
+func (m *manifest) applyChanges(changes []manifestChange) {
+	for _, c := range changes {
+		if c.op == setComparator {
+			m.comparators[c.table] = c.comparator
+		}
+		if c.op == dropTable {
+			delete(m.comparators, c.table)
+		}
+		if c.op != removeSegment {
+			continue
+		}
+		segments := make([]segmentInfo, 0)
+		for _, info := range m.tables[c.table] {
+			if info.keyFile != c.info.keyFile {
+				segments = append(segments, info)
+			}
+		}
+		m.tables[c.table] = segments
+	}
+	for _, c := range changes {
+		if (c.op == addSegment || c.op == setMaxSegmentID) && c.info.id > m.maxID {
+			m.maxID = c.info.id
+		}
+		if c.op != addSegment {
+			continue
+		}
+		segments := m.tables[c.table]
+		index := sort.Search(len(segments), func(i int) bool {
+			return segments[i].id > c.info.id
+		})
+		segments = append(segments, segmentInfo{})
+		copy(segments[index+1:], segments[index:])
+		segments[index] = c.info
+		m.tables[c.table] = segments
+	}
+}
+
+// returns the live segments of a table, in id order
+func (m *manifest) segments(table string) []segmentInfo {
+	m.Lock()
+	defer m.Unlock()
+
+	segments := make([]segmentInfo, len(m.tables[table]))
+	copy(segments, m.tables[table])
+	return segments
+}
+
+// reports whether a live segment of the table holds the segment id, either the segment itself or a merge of it
+func (m *manifest) holdsSegment(table string, id uint64) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	for _, info := range m.tables[table] {
+		if info.low <= id && id <= info.id {
+			return true
+		}
+	}
+	return false
+}
+
+// returns the name of the comparator recorded for the table, or "" if the table has none
+func (m *manifest) comparator(table string) string {
+	m.Lock()
+	defer m.Unlock()
+
+	name, ok := m.comparators[table]
+	if !ok && len(m.tables[table]) > 0 {
+		return BytewiseComparator.Name()
+	}
+	return name
+}
+
+// returns the tables that have segments or a comparator
+func (m *manifest) tableNames() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	var names []string
+	for table := range m.comparators {
+		names = append(names, table)
+	}
+	for table, segments := range m.tables {
+		if _, ok := m.comparators[table]; !ok && len(segments) > 0 {
+			names = append(names, table)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// returns the highest segment id of any segment the manifest has held, or recorded by setMaxSegmentID
+func (m *manifest) maxSegmentID() uint64 {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.maxID
+}
+
+func (m *manifest) close() error {
+	return m.file.Close()
+}
+
+func newSegmentInfo(ds *diskSegment) segmentInfo {
+	return segmentInfo{
+		keyFile:   filepath.Base(ds.keyFile.Name()),
+		dataFile:  filepath.Base(ds.dataFile.Name()),
+		low:       ds.low,
+		id:        ds.id,
+		version:   ds.version,
+		blockSize: ds.blockSize}
+}
+
+func encodeManifestEdit(changes []manifestChange) []byte {
+	payload := make([]byte, 5)
+	payload[0] = manifestEdit
+	binary.LittleEndian.PutUint32(payload[1:], uint32(len(changes)))
+
+	var buf [8]byte
+	putString := func(s string) {
+		binary.LittleEndian.PutUint16(buf[:], uint16(len(s)))
+		payload = append(payload, buf[:2]...)
+		payload = append(payload, s...)
+	}
+
+	for _, c := range changes {
+		payload = append(payload, c.op)
+		putString(c.table)
+		if c.op == setComparator {
+			putString(c.comparator)
+		} else {
+			putString(c.info.keyFile)
+		}
+		if c.op == addSegment {
+			putString(c.info.dataFile)
+			binary.LittleEndian.PutUint64(buf[:], c.info.low)
+			payload = append(payload, buf[:]...)
+			binary.LittleEndian.PutUint64(buf[:], c.info.id)
+			payload = append(payload, buf[:]...)
+			payload = append(payload, c.info.version)
+			binary.LittleEndian.PutUint32(buf[:], uint32(c.info.blockSize))
+			payload = append(payload, buf[:4]...)
+		}
+		if c.op == setMaxSegmentID {
+			binary.LittleEndian.PutUint64(buf[:], c.info.id)
+			payload = append(payload, buf[:]...)
+		}
+	}
+	return payload
+}
+
+func decodeManifestEdit(payload []byte) ([]manifestChange, error) {
+	if len(payload) < 5 || payload[0] != manifestEdit {
+		return nil, errCorruptManifest
+	}
+	count := binary.LittleEndian.Uint32(payload[1:])
+	payload = payload[5:]
+
+	getString := func() (string, error) {
+		if len(payload) < 2 {
+			return "", errCorruptManifest
+		}
+		n := int(binary.LittleEndian.Uint16(payload))
+		if len(payload) < 2+n {
+			return "", errCorruptManifest
+		}
+		s := string(payload[2 : 2+n])
+		payload = payload[2+n:]
+		return s, nil
+	}
+
+	changes := make([]manifestChange, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var c manifestChange
+		var err error
+
+		if len(payload) < 1 {
+			return nil, errCorruptManifest
+		}
+		c.op = payload[0]
+		payload = payload[1:]
+
+		if c.table, err = getString(); err != nil {
+			return nil, err
+		}
+		if c.info.keyFile, err = getString(); err != nil {
+			return nil, err
+		}
+		switch c.op {
+		case addSegment:
+			if c.info.dataFile, err = getString(); err != nil {
+				return nil, err
+			}
+			if len(payload) < 21 {
+				return nil, errCorruptManifest
+			}
+			c.info.low = binary.LittleEndian.Uint64(payload)
+			c.info.id = binary.LittleEndian.Uint64(payload[8:])
+			c.info.version = payload[16]
+			c.info.blockSize = int(binary.LittleEndian.Uint32(payload[17:]))
+			payload = payload[21:]
+		case removeSegment:
+		case setComparator:
+			c.comparator, c.info.keyFile = c.info.keyFile, ""
+		case dropTable:
+		case setMaxSegmentID:
+			if len(payload) < 8 {
+				return nil, errCorruptManifest
+			}
+			c.info.id = binary.LittleEndian.Uint64(payload)
+			payload = payload[8:]
+		default:
+			return nil, errCorruptManifest
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
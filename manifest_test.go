@@ -0,0 +1,65 @@
+package keydb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	path := "test/manifestdb"
+	Remove(path)
+
+	db, err := Open(path, true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 3; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	if n := len(db.manifest.segments("main")); n != 3 {
+		t.Fatal("manifest should contain 3 segments, has", n)
+	}
+	if err = db.CloseWithMerge(1); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// a segment that was written but never added to the manifest
+	data, _ := ioutil.ReadFile(path + "/main.keys.1")
+	ioutil.WriteFile(path+"/main.keys.99", data, os.ModePerm)
+	ioutil.WriteFile(path+"/main.data.99", data, os.ModePerm)
+
+	db, err = Open(path, false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if len(db.RecoveryReport()) != 2 {
+		t.Fatal("unreferenced segment files should be removed", db.RecoveryReport())
+	}
+	segments := db.manifest.segments("main")
+	if len(segments) != 1 || segments[0].low != 1 || segments[0].id != 3 {
+		t.Fatal("manifest should contain the merged segment", segments)
+	}
+
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := tx.Get([]byte(fmt.Sprint("mykey", i))); err != nil {
+			t.Fatal("unable to get by key", err)
+		}
+	}
+	tx.Commit()
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
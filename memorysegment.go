@@ -3,16 +3,24 @@ package keydb
 //
 // memorySegment wraps an im-memory binary Tree, so the number of items that can be inserted or removed
 // in a transaction is limited by available memory. the Tree uses a nil Value to designate a key that
-// has been removed from the table
+// has been removed from the table. a removed range is recorded as a range tombstone, and the keys already in
+// the segment within the range are removed, so the tombstone only needs to hide the keys of older segments.
+// an expired value reads as a removed key
 //
 
 type memorySegment struct {
-	tree *Tree
+	tree   *Tree
+	ranges []Range
 }
 
 func newMemorySegment() segment {
+	return newMemorySegmentWith(nil)
+}
+
+// returns a memory segment with the keys ordered by cmp
+func newMemorySegmentWith(cmp Comparator) segment {
 	ms := new(memorySegment)
-	ms.tree = &Tree{}
+	ms.tree = &Tree{cmp: cmp}
 
 	return ms
 }
@@ -22,12 +30,26 @@ func (ms *memorySegment) Put(key []byte, value []byte) error {
 	return nil
 }
 func (ms *memorySegment) Get(key []byte) ([]byte, error) {
-	value, ok := ms.tree.Find(key)
-	if !ok {
-		return nil, KeyNotFound
+	value, _, err := ms.GetEntry(key)
+	return value, err
+}
+func (ms *memorySegment) GetEntry(key []byte) ([]byte, bool, error) {
+	n := ms.tree.find(key)
+	if n == nil {
+		return nil, false, KeyNotFound
 	}
-	return value, nil
-
+	if expired(n.expires, nowNanos()) {
+		return nil, false, nil
+	}
+	return n.data, n.merge, nil
+}
+func (ms *memorySegment) PutOperands(key []byte, operands []byte) error {
+	ms.tree.insertOperands(key, operands)
+	return nil
+}
+func (ms *memorySegment) PutExpiring(key []byte, value []byte, expires int64) error {
+	ms.tree.insertExpiring(key, value, expires)
+	return nil
 }
 func (ms *memorySegment) Remove(key []byte) ([]byte, error) {
 	value, ok := ms.tree.Remove(key)
@@ -37,8 +59,37 @@ func (ms *memorySegment) Remove(key []byte) ([]byte, error) {
 	return nil, KeyNotFound
 }
 
+func (ms *memorySegment) RemoveRange(r Range) error {
+	for _, entry := range ms.tree.FindRange(r) {
+		if entry.Value != nil {
+			ms.tree.Insert(entry.Key, nil)
+		}
+	}
+	tombstone := Range{ExcludeLower: r.ExcludeLower, ExcludeUpper: r.ExcludeUpper}
+	if r.Lower != nil {
+		tombstone.Lower = append([]byte{}, r.Lower...)
+	}
+	if r.Upper != nil {
+		tombstone.Upper = append([]byte{}, r.Upper...)
+	}
+	ms.ranges = append(ms.ranges, tombstone)
+	return nil
+}
+
+func (ms *memorySegment) RangeTombstones() []Range {
+	return ms.ranges
+}
+
 func (ms *memorySegment) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
-	return &memorySegmentIterator{results: ms.tree.FindNodes(lower, upper), index: 0}, nil
+	return ms.LookupRange(Range{Lower: lower, Upper: upper}, false)
+}
+
+func (ms *memorySegment) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	return ms.LookupRange(Range{Lower: lower, Upper: upper}, true)
+}
+
+func (ms *memorySegment) LookupRange(r Range, reverse bool) (LookupIterator, error) {
+	return &memorySegmentIterator{results: ms.tree.FindRange(r), index: 0, reverse: reverse, now: nowNanos()}, nil
 }
 
 func (ms *memorySegment) Close() error {
@@ -48,7 +99,11 @@ func (ms *memorySegment) Close() error {
 // memorySegment迭代器
 type memorySegmentIterator struct {
 	results []TreeEntry // 迭代内容，即树节点
-	index   int // 当前位置
+	index   int         // 当前位置
+	reverse bool        // iterate from the last result
+	merge   bool        // the last value returned is a list of merge operands
+	expires int64       // the expiry of the last value returned
+	now     int64       // the values that expired before the iteration started are returned as removed
 }
 
 // 迭代获取next值
@@ -59,8 +114,14 @@ func (es *memorySegmentIterator) Next() (key []byte, value []byte, err error) {
 	}
 
 	/** 返回key/value，并自增当前位置index */
-	key = es.results[es.index].Key
-	value = es.results[es.index].Value
+	entry := es.results[es.position()]
+	key = entry.Key
+	value = entry.Value
+	es.merge = entry.merge
+	es.expires = entry.expires
+	if expired(entry.expires, es.now) {
+		value, es.merge, es.expires = nil, false, 0
+	}
 	es.index++
 	return key, value, nil
 }
@@ -70,6 +131,22 @@ func (es *memorySegmentIterator) peekKey() ([]byte, error) {
 	if es.index >= len(es.results) {
 		return nil, EndOfIterator
 	}
-	key := es.results[es.index].Key
+	key := es.results[es.position()].Key
 	return key, nil
 }
+
+func (es *memorySegmentIterator) operands() bool {
+	return es.merge
+}
+
+func (es *memorySegmentIterator) expiry() int64 {
+	return es.expires
+}
+
+// the index into results of the current position
+func (es *memorySegmentIterator) position() int {
+	if es.reverse {
+		return len(es.results) - 1 - es.index
+	}
+	return es.index
+}
@@ -0,0 +1,59 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MergeOperator combines the operands written by Transaction.Merge with the value of a key, which allows values
+// such as counters or lists to be updated without reading them first. the operands are stored as written, and are
+// applied when the key is read, or when the segments holding them are merged with the segment holding the value
+type MergeOperator interface {
+	// Name identifies the operator
+	Name() string
+	// Merge returns the value of the key after the operands are applied in order to the existing value. existing
+	// is nil if the key has no value or was removed, and a nil result removes the key. the operands and existing
+	// value must not be modified
+	Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+var errCorruptOperands = errors.New("corrupt merge operands")
+
+// appends an operand to an encoded list of operands, the format is a sequence of
+// len uint32
+// operand []byte
+// so two lists are combined by appending them
+func appendOperand(operands []byte, operand []byte) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(operand)))
+	operands = append(operands, buf[:]...)
+	return append(operands, operand...)
+}
+
+func decodeOperands(operands []byte) ([][]byte, error) {
+	var decoded [][]byte
+	for len(operands) > 0 {
+		if len(operands) < 4 {
+			return nil, errCorruptOperands
+		}
+		n := binary.LittleEndian.Uint32(operands)
+		if uint32(len(operands)-4) < n {
+			return nil, errCorruptOperands
+		}
+		decoded = append(decoded, operands[4:4+n:4+n])
+		operands = operands[4+n:]
+	}
+	return decoded, nil
+}
+
+// applies the encoded operands to the existing value
+func applyOperands(merge MergeOperator, key []byte, existing []byte, operands []byte) ([]byte, error) {
+	if merge == nil {
+		return nil, NoMergeOperator
+	}
+	decoded, err := decodeOperands(operands)
+	if err != nil {
+		return nil, err
+	}
+	return merge.Merge(key, existing, decoded)
+}
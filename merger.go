@@ -3,15 +3,12 @@ package keydb
 import (
 	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"time"
 )
 
-var maxSegments = 8
-
 // merge on disk segments for the database
 func mergeDiskSegments(db *Database) {
 	defer db.wg.Done()
@@ -31,7 +28,7 @@ func mergeDiskSegments(db *Database) {
 
 		db.Unlock()
 
-		err := mergeDiskSegments0(db, maxSegments)
+		err := mergeDiskSegments0(db, 0)
 		if err != nil {
 			db.Lock()
 			db.err = errors.New("unable to merge segments: " + err.Error())
@@ -40,11 +37,12 @@ func mergeDiskSegments(db *Database) {
 
 		db.wg.Done()
 
-		time.Sleep(1 * time.Second)
+		time.Sleep(db.options.MergeInterval)
 	}
 }
 
 // 合并一个数据库db下面的所有表的diskSegment，单表最多保存的segment数量由segmentCount指定
+// if segmentCount is 0 the MaxSegments of each table is used
 func mergeDiskSegments0(db *Database, segmentCount int) error {
 	db.Lock()
 	copy := make([]*internalTable, 0)
@@ -54,7 +52,11 @@ func mergeDiskSegments0(db *Database, segmentCount int) error {
 	db.Unlock()
 
 	for _, table := range copy {
-		err := mergeTableSegments(db, table, segmentCount)
+		count := segmentCount
+		if count == 0 {
+			count = table.options.maxSegments
+		}
+		err := mergeTableSegments(db, table, count)
 		if err != nil {
 			return err
 		}
@@ -64,6 +66,13 @@ func mergeDiskSegments0(db *Database, segmentCount int) error {
 
 // 合并单个表的diskSegment
 func mergeTableSegments(db *Database, table *internalTable, segmentCount int) error {
+	table.merge.Lock()
+	defer table.merge.Unlock()
+
+	// the table was dropped or renamed after the tables were copied
+	if table.dropped {
+		return nil
+	}
 
 	// ??
 	var index = 0
@@ -110,12 +119,18 @@ func mergeTableSegments(db *Database, table *internalTable, segmentCount int) er
 
 		// 最后一个segment的id, 由于segments本身有序，最后一个segment即是最新的segment
 		id := mergable[len(mergable)-1].id
+		// the lowest id covered by the merged segment, recorded so an interrupted merge can be completed on open
+		low := mergable[0].low
 		// index=0, segments[0, 0+mergable.len] 即 segments.id[1, 4]
 		// index=1, segments[1, 1+mergable.len] 即 segments.id[2, 5]
 		segments = segments[index : index+len(mergable)]
 
-		newseg, err := mergeDiskSegments1(db.path, table.name, id, segments)
-		if err != nil {
+		// when the oldest segment is merged there is no older value for a removed key to hide, so the
+		// removed keys are dropped. if every key was removed there is no merged segment
+		purge := index == 0
+
+		newseg, err := mergeDiskSegments1(db.path, table.name, low, id, segments, purge, db.segmentOptions(table.name))
+		if err != nil && err != errEmptySegment {
 			return err
 		}
 
@@ -130,18 +145,31 @@ func mergeTableSegments(db *Database, table *internalTable, segmentCount int) er
 
 		for i, s := range mergable {
 			if s != segments[i+index] {
+				table.Unlock()
 				return errors.New(fmt.Sprint("unexpected segment change,", s, segments[i]))
 			}
 		}
 
+		// the merged segment replaces its sources in a single manifest edit, so a crash either keeps the sources
+		// or the merged segment, and the other files are removed when the database is opened
+		var changes []manifestChange
+		if newseg != nil {
+			changes = append(changes, manifestChange{op: addSegment, table: table.name, info: newSegmentInfo(newseg.(*diskSegment))})
+		}
 		for _, s := range mergable {
-			err0 := s.keyFile.Close()
-			err1 := s.dataFile.Close()
-			err2 := os.Remove(s.keyFile.Name())
-			err3 := os.Remove(s.dataFile.Name())
+			changes = append(changes, manifestChange{op: removeSegment, table: table.name, info: newSegmentInfo(s)})
+		}
+		err = db.manifest.apply(changes, db.durability() >= SyncOnSegmentWrite)
+		if err != nil {
+			table.Unlock()
+			return err
+		}
 
-			err := errn(err0, err1, err2, err3)
+		for _, s := range mergable {
+			// the files are kept while read only transactions are using the segment
+			err := s.removeWhenReleased()
 			if err != nil {
+				table.Unlock()
 				return err
 			}
 		}
@@ -150,7 +178,9 @@ func mergeTableSegments(db *Database, table *internalTable, segmentCount int) er
 		newsegments := make([]segment, 0)
 
 		newsegments = append(newsegments, segments[:index]...)
-		newsegments = append(newsegments, newseg)
+		if newseg != nil {
+			newsegments = append(newsegments, newseg)
+		}
 		newsegments = append(newsegments, segments[index+len(mergable):]...)
 
 		table.segments = newsegments
@@ -164,9 +194,12 @@ func mergeTableSegments(db *Database, table *internalTable, segmentCount int) er
 var mergeSeq uint64
 
 // 将多个segment合并到一个diskSegment
-func mergeDiskSegments1(dbpath string, table string, id uint64, segments []segment) (segment, error) {
+// the merged files are named table.merged.low.seq.keys.id, where low and id are the range of segment ids replaced
+// by the merge. databases written by older versions omit the low id
+// if purge is true the removed keys are not written, and errEmptySegment is returned if no keys remain
+func mergeDiskSegments1(dbpath string, table string, low uint64, id uint64, segments []segment, purge bool, options segmentOptions) (segment, error) {
 
-	base := filepath.Join(dbpath, table+".merged.") // TODO 重复的'.'
+	base := filepath.Join(dbpath, table+".merged."+strconv.FormatUint(low, 10))
 
 	sid := strconv.FormatUint(id, 10)
 
@@ -176,12 +209,49 @@ func mergeDiskSegments1(dbpath string, table string, id uint64, segments []segme
 	keyFilename := base + "." + sseq + ".keys." + sid
 	dataFilename := base + "." + sseq + ".data." + sid
 
-	ms := newMultiSegment(segments)
+	ms := newMultiSegmentWith(segments, options.cmp)
+	// the operands of keys without a value in the merged segments are kept, unless the oldest segments are merged
+	ms.merge = options.merge
+	ms.partial = !purge
 	itr, err := ms.Lookup(nil, nil)
 	if err != nil {
 		return nil, err
 	}
+	// the keys removed by a range tombstone are skipped by the iterator, but the tombstones still hide the keys of
+	// older segments, unless there are none
+	var ranges []Range
+	if purge {
+		itr = &purgeIterator{itr}
+	} else {
+		ranges = ms.RangeTombstones()
+	}
 
-	return writeAndLoadSegment(keyFilename, dataFilename, itr)
+	return writeAndLoadSegment(keyFilename, dataFilename, itr, ranges, options)
+
+}
+
+// purgeIterator skips the removed keys of the iterator it wraps
+type purgeIterator struct {
+	itr LookupIterator
+}
+
+func (pi *purgeIterator) Next() (key []byte, value []byte, err error) {
+	for {
+		key, value, err = pi.itr.Next()
+		if err != nil || value != nil {
+			return
+		}
+	}
+}
+
+func (pi *purgeIterator) operands() bool {
+	return pi.itr.operands()
+}
+
+func (pi *purgeIterator) expiry() int64 {
+	return pi.itr.expiry()
+}
 
+func (pi *purgeIterator) peekKey() ([]byte, error) {
+	panic("peekKey called on purgeIterator")
 }
@@ -2,8 +2,11 @@ package keydb
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMerger(t *testing.T) {
@@ -18,7 +21,7 @@ func TestMerger(t *testing.T) {
 		m2.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
 	}
 
-	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m1, m2})
+	merged, err := mergeDiskSegments1("test", "testtable", 0, 0, []segment{m1, m2}, false, defaultSegmentOptions)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -51,7 +54,7 @@ func TestMergerRemove(t *testing.T) {
 		m2.Remove([]byte(fmt.Sprint("mykey", i)))
 	}
 
-	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m1, m2})
+	merged, err := mergeDiskSegments1("test", "testtable", 0, 0, []segment{m1, m2}, false, defaultSegmentOptions)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,3 +76,317 @@ func TestMergerRemove(t *testing.T) {
 		t.Fatal("wrong number of records", count)
 	}
 }
+
+func TestMergerPurge(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m1 := newMemorySegment()
+	for i := 0; i < 1000; i++ {
+		m1.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	m2 := newMemorySegment()
+	for i := 0; i < 500; i++ {
+		m2.Remove([]byte(fmt.Sprint("mykey", i)))
+	}
+	m2.Remove([]byte("notakey"))
+
+	merged, err := mergeDiskSegments1("test", "testtable", 0, 0, []segment{m1, m2}, true, defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itr, err := merged.Lookup(nil, nil)
+	count := 0
+
+	for {
+		_, v, err := itr.Next()
+		if err != nil {
+			break
+		}
+		if v == nil {
+			t.Fatal("removed key should of been purged")
+		}
+		count++
+	}
+
+	if count != 500 {
+		t.Fatal("wrong number of records", count)
+	}
+
+	m3 := newMemorySegment()
+	for i := 500; i < 1000; i++ {
+		m3.Remove([]byte(fmt.Sprint("mykey", i)))
+	}
+	_, err = mergeDiskSegments1("test", "testtable", 0, 1, []segment{merged, m3}, true, defaultSegmentOptions)
+	if err != errEmptySegment {
+		t.Fatal("merge of only removed keys should be empty", err)
+	}
+}
+
+func TestMergerRangeTombstones(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m1 := newMemorySegment()
+	for i := 0; i < 1000; i++ {
+		m1.Put([]byte(fmt.Sprintf("mykey%04d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	// the tombstone hides the keys of m1, but not the key put after it
+	m2 := newMemorySegment()
+	m2.Put([]byte("mykey0100"), []byte("removed"))
+	m2.RemoveRange(Range{Lower: []byte("mykey0100"), Upper: []byte("mykey0199")})
+	m2.Put([]byte("mykey0150"), []byte("updated"))
+	// a segment with only a tombstone has no keys
+	m3 := newMemorySegment()
+	m3.RemoveRange(Range{Lower: []byte("mykey0900")})
+	itr, err := m3.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, m3.RangeTombstones(), defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if len(ds.RangeTombstones()) != 1 || string(ds.RangeTombstones()[0].Lower) != "mykey0900" || ds.RangeTombstones()[0].Upper != nil {
+		t.Fatal("incorrect range tombstones", ds.RangeTombstones())
+	}
+
+	check := func(s segment, tombstones int) {
+		if len(s.RangeTombstones()) != tombstones {
+			t.Fatal("incorrect number of range tombstones", len(s.RangeTombstones()))
+		}
+		itr, err := s.Lookup(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for {
+			key, value, err := itr.Next()
+			if err != nil {
+				break
+			}
+			if value == nil {
+				continue
+			}
+			if string(key) == "mykey0150" && string(value) != "updated" {
+				t.Fatal("incorrect value", string(value))
+			}
+			count++
+		}
+		if count != 1000-100-100+1 {
+			t.Fatal("wrong number of records", count)
+		}
+	}
+
+	merged, err := mergeDiskSegments1("test", "testtable", 0, 1, []segment{m1, m2, ds}, false, defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(merged, 2)
+	merged.Close()
+
+	merged, err = mergeDiskSegments1("test", "testtable", 0, 2, []segment{m1, m2, ds}, true, defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(merged, 0)
+	merged.Close()
+}
+
+// appendOperator appends the operands to the value
+type appendOperator struct{}
+
+func (appendOperator) Name() string {
+	return "test.AppendOperator"
+}
+
+func (appendOperator) Merge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	value := append([]byte(nil), existing...)
+	for _, operand := range operands {
+		value = append(value, operand...)
+	}
+	return value, nil
+}
+
+func TestMergerOperands(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m1 := newMemorySegment()
+	m1.Put([]byte("mykey1"), []byte("a"))
+	m2 := newMemorySegment()
+	m2.PutOperands([]byte("mykey1"), appendOperand(nil, []byte("b")))
+	m2.PutOperands([]byte("mykey2"), appendOperand(nil, []byte("b")))
+	m3 := newMemorySegment()
+	m3.PutOperands([]byte("mykey1"), appendOperand(appendOperand(nil, []byte("c")), []byte("d")))
+	m3.PutOperands([]byte("mykey2"), appendOperand(nil, []byte("c")))
+
+	options := defaultSegmentOptions
+	options.merge = appendOperator{}
+
+	// without the oldest segment the operands of a key without a value are kept
+	merged, err := mergeDiskSegments1("test", "testtable", 1, 2, []segment{m2, m3}, false, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Close()
+	value, operands, err := merged.GetEntry([]byte("mykey2"))
+	if err != nil || !operands {
+		t.Fatal("operands should be kept", err)
+	}
+	if decoded, err := decodeOperands(value); err != nil || len(decoded) != 2 || string(decoded[0]) != "b" || string(decoded[1]) != "c" {
+		t.Fatal("incorrect operands", decoded, err)
+	}
+
+	ms := newMultiSegment([]segment{m1, merged})
+	ms.merge = appendOperator{}
+	if value, err := ms.Get([]byte("mykey1")); err != nil || string(value) != "abcd" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+
+	merged2, err := mergeDiskSegments1("test", "testtable", 0, 3, []segment{m1, merged}, true, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged2.Close()
+	itr, err := merged2.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"abcd", "bc"}
+	for i := 0; ; i++ {
+		_, value, err := itr.Next()
+		if err != nil {
+			if i != len(expected) {
+				t.Fatal("wrong number of records", i)
+			}
+			break
+		}
+		if itr.operands() || string(value) != expected[i] {
+			t.Fatal("operands should be applied", string(value))
+		}
+	}
+
+	// the operands cannot be applied without an operator
+	_, err = mergeDiskSegments1("test", "testtable", 0, 4, []segment{m1, merged}, true, defaultSegmentOptions)
+	if err != NoMergeOperator {
+		t.Fatal("merge should fail without an operator", err)
+	}
+}
+
+func TestMergerExpiry(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	now := nowNanos()
+	m1 := newMemorySegment()
+	m1.Put([]byte("mykey1"), []byte("myvalue1"))
+	m1.Put([]byte("mykey2"), []byte("myvalue2"))
+	m2 := newMemorySegment()
+	m2.PutExpiring([]byte("mykey1"), []byte("expired"), now-1)
+	m2.PutExpiring([]byte("mykey3"), []byte("myvalue3"), now+int64(time.Hour))
+
+	// the expired value hides the older value
+	merged, err := mergeDiskSegments1("test", "testtable", 0, 1, []segment{m1, m2}, false, defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged.Close()
+	if value, err := merged.Get([]byte("mykey1")); err != nil || value != nil {
+		t.Fatal("expired key should be removed", string(value), err)
+	}
+
+	merged2, err := mergeDiskSegments1("test", "testtable", 0, 2, []segment{merged}, true, defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer merged2.Close()
+	itr, err := merged2.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for {
+		key, _, err := itr.Next()
+		if err != nil {
+			break
+		}
+		if string(key) == "mykey1" {
+			t.Fatal("expired key should be purged")
+		}
+		if string(key) == "mykey3" && itr.expiry() != now+int64(time.Hour) {
+			t.Fatal("incorrect expiry", itr.expiry())
+		}
+		count++
+	}
+	if count != 2 {
+		t.Fatal("wrong number of records", count)
+	}
+}
+
+func TestMergerCorruptSegment(t *testing.T) {
+	Remove("test/mydb")
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 3; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		for j := 0; j < 500; j++ {
+			tx.Put([]byte(fmt.Sprintf("mykey%d.%04d", i, j)), []byte(fmt.Sprint("myvalue", j)))
+		}
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// a block in the middle of the second segment is corrupt
+	db, err = Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	sources := db.manifest.segments("main")
+	if len(sources) != 3 {
+		t.Fatal("expected 3 segments", sources)
+	}
+	f, err := os.OpenFile("test/mydb/"+sources[1].keyFile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal("unable to open key file", err)
+	}
+	f.WriteAt([]byte{0xFF, 0xFF, 0xFF, 0xFF}, defaultKeyBlockSize+10)
+	f.Close()
+
+	db.Lock()
+	table, err := db.getTable("main")
+	db.Unlock()
+	if err != nil {
+		t.Fatal("unable to load table", err)
+	}
+	if err = mergeTableSegments(db, table, 1); err == nil {
+		t.Fatal("the merge should fail")
+	}
+
+	// the sources are kept, and no merged segment is left behind
+	if segments := db.manifest.segments("main"); fmt.Sprint(segments) != fmt.Sprint(sources) {
+		t.Fatal("the segments were changed", segments)
+	}
+	if len(table.segments) != 3 {
+		t.Fatal("the segments were changed", len(table.segments))
+	}
+	for _, info := range sources {
+		if _, err := os.Stat("test/mydb/" + info.dataFile); err != nil {
+			t.Fatal("a source segment was removed", err)
+		}
+	}
+	files, _ := ioutil.ReadDir("test/mydb")
+	for _, f := range files {
+		if strings.Contains(f.Name(), ".merged.") {
+			t.Fatal("the merged segment was not removed", f.Name())
+		}
+	}
+	db.CloseWithMerge(0)
+}
@@ -4,23 +4,72 @@ package keydb
 // may contain the same key with different values (due to an update or a remove)
 type multiSegment struct {
 	segments []segment
+	cmp      Comparator
+	// applies the merge operands of a key to the value in the older segments
+	merge MergeOperator
+	// if true the iterators return the merge operands of a key that has no value in the segments, rather than
+	// applying them to a missing value, which is used when merging segments that are not the oldest
+	partial bool
 }
 
 type multiSegmentIterator struct {
 	iterators []LookupIterator
+	ranges    [][]Range // the range tombstones of the segment of each iterator
+	reverse   bool      // the iterators return descending keys
+	cmp       Comparator
+	merge     MergeOperator
+	partial   bool
+	operand   bool  // the last value returned is a list of merge operands
+	expires   int64 // the expiry of the last value returned
 }
 
 func (msi *multiSegmentIterator) peekKey() ([]byte, error) {
 	panic("peekKey called on multiSegmentIterator")
 }
 
-// 遍历multiSegment
+func (msi *multiSegmentIterator) operands() bool {
+	return msi.operand
+}
+
+func (msi *multiSegmentIterator) expiry() int64 {
+	return msi.expires
+}
+
+// returns true if a is before b in the order of the iteration
+func (msi *multiSegmentIterator) before(a, b []byte) bool {
+	if msi.reverse {
+		return lessKeys(msi.cmp, b, a)
+	}
+	return lessKeys(msi.cmp, a, b)
+}
+
+// returns true if the key of segment index is removed by a range tombstone of a newer segment
+func (msi *multiSegmentIterator) covered(index int, key []byte) bool {
+	for i := index + 1; i < len(msi.ranges); i++ {
+		if rangesContain(msi.ranges[i], msi.cmp, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// 遍历multiSegment. the keys removed by a range tombstone are skipped
 func (msi *multiSegmentIterator) Next() (key []byte, value []byte, err error) {
+	for {
+		index, key, value, err := msi.next()
+		if err != nil || !msi.covered(index, key) {
+			return key, value, err
+		}
+	}
+}
+
+// returns the next key, and the index of the segment it was read from
+func (msi *multiSegmentIterator) next() (index int, key []byte, value []byte, err error) {
 	var currentIndex = -1
-	var lowest []byte
+	var next []byte
 
-	// find the lowest next non-deleted key in any of the iterators
-	// 找lowest key，并获取其所属的segments[]下标currentIndex
+	// find the next key in any of the iterators, the newest segment wins if several contain the key
+	// 找next key，并获取其所属的segments[]下标currentIndex
 
 	for i := len(msi.iterators) - 1; i >= 0; i-- {
 		iterator := msi.iterators[i]
@@ -36,23 +85,32 @@ func (msi *multiSegmentIterator) Next() (key []byte, value []byte, err error) {
 			}
 		}
 
-		if err != nil {
+		if err == EndOfIterator {
 			continue
 		}
+		if err != nil {
+			return -1, nil, nil, err
+		}
 
-		if lowest == nil || less(key, lowest) { // key < lowest
-			lowest = make([]byte, len(key))
-			copy(lowest, key)
+		if next == nil || msi.before(key, next) {
+			next = make([]byte, len(key))
+			copy(next, key)
 			currentIndex = i
 		}
 	}
 
 	if currentIndex == -1 {
-		return nil, nil, EndOfIterator
+		return -1, nil, nil, EndOfIterator
 	}
 
-	// 最小key/value
+	index = currentIndex
 	key, value, err = msi.iterators[currentIndex].Next()
+	msi.operand = false
+	msi.expires = msi.iterators[currentIndex].expiry()
+	if err == nil && value != nil && msi.iterators[currentIndex].operands() && !msi.covered(currentIndex, key) {
+		// the value of a merge does not expire
+		value, err = msi.resolve(currentIndex, key, value)
+	}
 
 	// advance all of the iterators past the current
 	for i := len(msi.iterators) - 1; i >= 0; i-- {
@@ -65,8 +123,8 @@ func (msi *multiSegmentIterator) Next() (key []byte, value []byte, err error) {
 			if err != nil {
 				break
 			}
-			if key == nil || !less(lowest, key) {
-				msi.Next()
+			if key == nil || !msi.before(next, key) {
+				iterator.Next()
 			} else {
 				break
 			}
@@ -76,39 +134,144 @@ func (msi *multiSegmentIterator) Next() (key []byte, value []byte, err error) {
 	return
 }
 
+// applies the merge operands of the key in segment index to the entries of the key in the older segments, which the
+// iterators are positioned at if they contain the key
+func (msi *multiSegmentIterator) resolve(index int, key []byte, operands []byte) ([]byte, error) {
+	for i := index - 1; i >= 0; i-- {
+		if rangesContain(msi.ranges[i+1], msi.cmp, key) {
+			return applyOperands(msi.merge, key, nil, operands)
+		}
+		iterator := msi.iterators[i]
+		next, err := iterator.peekKey()
+		for err == nil && next == nil {
+			iterator.Next()
+			next, err = iterator.peekKey()
+		}
+		if err == EndOfIterator || (err == nil && !equalKeys(msi.cmp, next, key)) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, value, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if value == nil || !iterator.operands() {
+			return applyOperands(msi.merge, key, value, operands)
+		}
+		// the older operands are applied first
+		operands = append(append([]byte(nil), value...), operands...)
+	}
+	if msi.partial {
+		msi.operand = true
+		return operands, nil
+	}
+	return applyOperands(msi.merge, key, nil, operands)
+}
+
 func newMultiSegment(segments []segment) *multiSegment {
 	return &multiSegment{segments: segments}
 }
 
+// returns a multiSegment merging segments with the keys ordered by cmp
+func newMultiSegmentWith(segments []segment, cmp Comparator) *multiSegment {
+	return &multiSegment{segments: segments, cmp: cmp}
+}
+
 func (ms *multiSegment) Put(key []byte, value []byte) error {
 	panic("Put called on multiSegmentIterator")
 }
 
+func (ms *multiSegment) PutOperands(key []byte, operands []byte) error {
+	panic("PutOperands called on multiSegmentIterator")
+}
+
+func (ms *multiSegment) PutExpiring(key []byte, value []byte, expires int64) error {
+	panic("PutExpiring called on multiSegmentIterator")
+}
+
 func (ms *multiSegment) Get(key []byte) ([]byte, error) {
+	value, _, err := ms.GetEntry(key)
+	return value, err
+}
+
+// GetEntry returns the value of the key with the merge operands applied, unless the multiSegment is partial and the
+// key has no value in the segments
+func (ms *multiSegment) GetEntry(key []byte) ([]byte, bool, error) {
+	var operands []byte
 	// segments are in chronological order, so search in reverse
 	for i := len(ms.segments) - 1; i >= 0; i-- {
 		s := ms.segments[i]
-		val, err := s.Get(key)
+		val, merge, err := s.GetEntry(key)
+		if err != nil && err != KeyNotFound {
+			return nil, false, err
+		}
+		if err == nil && (val == nil || !merge) {
+			if operands == nil {
+				return val, false, nil
+			}
+			val, err = applyOperands(ms.merge, key, val, operands)
+			return val, false, err
+		}
 		if err == nil {
-			return val, nil
+			// the older operands are applied first
+			operands = append(append([]byte(nil), val...), operands...)
+		}
+		// a removed range hides the key in the older segments
+		if rangesContain(s.RangeTombstones(), ms.cmp, key) {
+			if operands == nil {
+				return nil, false, nil
+			}
+			val, err = applyOperands(ms.merge, key, nil, operands)
+			return val, false, err
 		}
 	}
-	return nil, KeyNotFound
+	if operands == nil {
+		return nil, false, KeyNotFound
+	}
+	if ms.partial {
+		return operands, true, nil
+	}
+	val, err := applyOperands(ms.merge, key, nil, operands)
+	return val, false, err
 }
 
 func (ms *multiSegment) Remove(key []byte) ([]byte, error) {
 	panic("Remove called on multiSegmentIterator")
 }
 
+func (ms *multiSegment) RemoveRange(r Range) error {
+	panic("RemoveRange called on multiSegmentIterator")
+}
+
+func (ms *multiSegment) RangeTombstones() []Range {
+	var ranges []Range
+	for _, s := range ms.segments {
+		ranges = append(ranges, s.RangeTombstones()...)
+	}
+	return ranges
+}
+
 // 构造multiSegment的迭代器，实现类似于操作单个segment的效果
 func (ms *multiSegment) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
+	return ms.LookupRange(Range{Lower: lower, Upper: upper}, false)
+}
+
+func (ms *multiSegment) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	return ms.LookupRange(Range{Lower: lower, Upper: upper}, true)
+}
+
+func (ms *multiSegment) LookupRange(r Range, reverse bool) (LookupIterator, error) {
 	iterators := make([]LookupIterator, 0)
+	ranges := make([][]Range, 0)
 	for _, v := range ms.segments {
-		iterator, err := v.Lookup(lower, upper)
+		iterator, err := v.LookupRange(r, reverse)
 		if err != nil {
 			return nil, err
 		}
 		iterators = append(iterators, iterator)
+		ranges = append(ranges, v.RangeTombstones())
 	}
-	return &multiSegmentIterator{iterators: iterators}, nil
+	return &multiSegmentIterator{iterators: iterators, ranges: ranges, reverse: reverse, cmp: ms.cmp, merge: ms.merge, partial: ms.partial}, nil
 }
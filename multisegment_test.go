@@ -2,6 +2,7 @@ package keydb
 
 import (
 	"fmt"
+	"os"
 	"testing"
 )
 
@@ -62,3 +63,77 @@ func TestMultiSegment2(t *testing.T) {
 	}
 
 }
+
+func TestMultiSegmentReverse(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+
+	m1 := newMemorySegment()
+	for i := 0; i < 10000; i++ {
+		m1.Put([]byte(fmt.Sprintf("mykey%05d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	itr, err := m1.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, nil, defaultSegmentOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2 := newMemorySegment()
+	for i := 2000; i < 2010; i++ {
+		m2.Remove([]byte(fmt.Sprintf("mykey%05d", i)))
+	}
+	m2.Put([]byte("mykey05000"), []byte("updated"))
+
+	ms := newMultiSegment([]segment{ds, m2})
+
+	itr, err = ms.LookupReverse([]byte("mykey01000"), []byte("mykey06000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	var prev []byte
+	for {
+		key, value, err := itr.Next()
+		if err != nil {
+			break
+		}
+		if prev == nil && string(key) != "mykey06000" {
+			t.Fatal("reverse lookup should start at upper", string(key))
+		}
+		if prev != nil && !lessKeys(nil, key, prev) {
+			t.Fatal("keys should be descending", string(key), string(prev))
+		}
+		if string(key) == "mykey05000" && string(value) != "updated" {
+			t.Fatal("newest segment should win", string(value))
+		}
+		prev = append(prev[:0], key...)
+		if value != nil {
+			count++
+		}
+	}
+	if count != 5001-10 {
+		t.Fatal("incorrect count", count)
+	}
+	if string(prev) != "mykey01000" {
+		t.Fatal("reverse lookup should end at lower", string(prev))
+	}
+
+	itr, err = ms.LookupReverse(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count = 0
+	for {
+		_, _, err := itr.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 10000 {
+		t.Fatal("incorrect count", count)
+	}
+	ds.Close()
+}
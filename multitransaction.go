@@ -0,0 +1,218 @@
+package keydb
+
+import (
+	"errors"
+	"sort"
+)
+
+// MultiTransaction updates several tables as a single atomic unit. the changes to every table become visible
+// together when it commits, and after a crash either all of them or none of them are recovered.
+// a MultiTransaction can only be used by a single Go routine.
+// each transaction should be completed with either Commit, or Rollback
+type MultiTransaction struct {
+	db     *Database
+	open   bool
+	tables []string // sorted, which is the order the tables are locked
+	txs    map[string]*Transaction
+}
+
+// BeginMultiTX starts a transaction for several database tables. the tables are read and written through the
+// Transaction returned by Table, which cannot be committed on its own
+func (db *Database) BeginMultiTX(tables ...string) (*MultiTransaction, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	db.waitForQuiesce()
+
+	if db.err != nil {
+		return nil, db.err
+	}
+
+	if db.closing {
+		return nil, DatabaseClosed
+	}
+
+	mtx := &MultiTransaction{db: db, open: true, txs: make(map[string]*Transaction)}
+
+	its := make([]*internalTable, 0)
+	for _, table := range tables {
+		if _, ok := mtx.txs[table]; ok {
+			continue
+		}
+		mtx.txs[table] = nil
+		mtx.tables = append(mtx.tables, table)
+	}
+	sort.Strings(mtx.tables)
+	for _, table := range mtx.tables {
+		it, err := db.getTable(table)
+		if err != nil {
+			return nil, err
+		}
+		its = append(its, it)
+	}
+
+	db.waitForMerges(its...)
+
+	// the transactions start together, so they read the tables as of the same commit
+	for _, it := range its {
+		tx := db.beginTX0(it)
+		tx.parent = mtx
+		mtx.txs[it.name] = tx
+	}
+
+	return mtx, nil
+}
+
+// Table returns the transaction used to read and write the table
+func (mtx *MultiTransaction) Table(table string) (*Transaction, error) {
+	if !mtx.open {
+		return nil, TransactionClosed
+	}
+	tx, ok := mtx.txs[table]
+	if !ok {
+		return nil, TableNotInTransaction
+	}
+	return tx, nil
+}
+
+// Commit persists the changes to every table. the changes are recorded in the write-ahead log as a single record
+// before Commit returns, and the disk segments are written in the background. if the transaction of any table
+// conflicts with another transaction, no changes are made and a *ConflictError is returned, see Isolation.
+// after Commit the transaction can no longer be used
+func (mtx *MultiTransaction) Commit() error {
+	records, tables, err := mtx.commit()
+	if err != nil {
+		return err
+	}
+
+	db := mtx.db
+	go func() {
+		for i, rec := range records {
+			err := writeSegmentToDisk(db, tables[i], rec.id, rec.seg)
+			if err != nil {
+				db.Lock()
+				db.err = errors.New("transaction failed: " + err.Error())
+				db.Unlock()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// CommitSync persists the changes to every table, waiting for the disk segments to be written. see Commit and
+// Transaction.CommitSync
+func (mtx *MultiTransaction) CommitSync() error {
+	records, tables, err := mtx.commit()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i, rec := range records {
+		errs = append(errs, writeSegmentToDisk(mtx.db, tables[i], rec.id, rec.seg))
+	}
+	return errn(errs...)
+}
+
+// Rollback discards the changes to every table. after Rollback the transaction can no longer be used
+func (mtx *MultiTransaction) Rollback() error {
+	db := mtx.db
+
+	db.Lock()
+	defer db.Unlock()
+
+	if !mtx.open {
+		return TransactionClosed
+	}
+	mtx.close()
+
+	for _, tx := range mtx.txs {
+		table := db.tables[tx.table]
+		table.Lock()
+		tx.multi = nil
+		table.transactions--
+		table.abortCommit(tx)
+		table.Unlock()
+	}
+	return nil
+}
+
+// ends the transactions. the database must be locked
+func (mtx *MultiTransaction) close() {
+	mtx.open = false
+	for _, tx := range mtx.txs {
+		tx.open = false
+		delete(mtx.db.transactions, tx.id)
+	}
+}
+
+// logs the changes of every table and makes them visible, returning the segments to write to disk and their tables
+func (mtx *MultiTransaction) commit() ([]walRecord, []*internalTable, error) {
+	db := mtx.db
+
+	// holding the database lock while the segments are added means no transaction can start with only some of
+	// the changes visible
+	db.Lock()
+	defer db.Unlock()
+
+	if !mtx.open {
+		return nil, nil, TransactionClosed
+	}
+	mtx.close()
+
+	tables := make([]*internalTable, 0)
+	for _, name := range mtx.tables {
+		table := db.tables[name]
+		table.Lock()
+		defer table.Unlock()
+		table.transactions--
+		tables = append(tables, table)
+	}
+
+	abort := func() {
+		for i, table := range tables {
+			table.abortCommit(mtx.txs[mtx.tables[i]])
+		}
+	}
+
+	if db.err != nil {
+		abort()
+		return nil, nil, db.err
+	}
+
+	isolation := db.options.Isolation
+
+	// every table is checked before any commit is recorded, so a conflict leaves every table unchanged
+	writes := make([]committedWrites, len(tables))
+	for i, table := range tables {
+		w, err := table.checkCommit(mtx.txs[mtx.tables[i]], isolation)
+		if err != nil {
+			abort()
+			return nil, nil, err
+		}
+		writes[i] = w
+	}
+
+	records := make([]walRecord, 0)
+	for _, name := range mtx.tables {
+		tx := mtx.txs[name]
+		records = append(records, walRecord{id: db.nextSegmentID(), table: name, seg: tx.memory})
+	}
+
+	// the segments are logged before they become visible, so the commit survives a crash
+	err := db.wal.logSegments(records, db.durability() >= SyncOnCommit)
+	if err != nil {
+		abort()
+		return nil, nil, err
+	}
+
+	for i, table := range tables {
+		table.recordCommit(mtx.txs[mtx.tables[i]], writes[i], isolation)
+		table.segments = append(table.segments, records[i].seg)
+	}
+
+	db.wg.Add(len(records))
+
+	return records, tables, nil
+}
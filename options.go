@@ -0,0 +1,220 @@
+package keydb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const defaultMaxSegments = 8
+const defaultKeyBlockSize = 4096
+const defaultKeyIndexInterval = 2 // record every 2nd block
+const defaultMergeInterval = 1 * time.Second
+
+const minKeyBlockSize = 2048 // must hold a key of maxKeySize
+const maxKeyBlockSize = 1024 * 1024
+
+// Options control the behavior of a database opened with OpenWithOptions. A zero value uses the default for that setting.
+type Options struct {
+	// CreateIfNeeded creates the database if it does not exist
+	CreateIfNeeded bool
+	// Durability controls when writes are synced to disk, see SetDurability
+	Durability Durability
+	// Isolation controls whether concurrent write transactions on a table are checked for conflicts, default NoIsolation
+	Isolation Isolation
+	// MergeInterval is the time the merger waits between merges, default 1 second
+	MergeInterval time.Duration
+	// BlockCacheSize is the approximate memory in bytes used to cache the decoded key blocks of all tables, default
+	// 8MB. a negative value disables the cache
+	BlockCacheSize int64
+
+	// MaxSegments is the number of segments per table the merger reduces a table to, default 8
+	MaxSegments int
+	// KeyBlockSize is the size in bytes of the blocks in newly written key files, default 4096. Existing segments keep the
+	// block size they were written with
+	KeyBlockSize int
+	// KeyIndexInterval is the number of key blocks between the keys held in memory to narrow the search of a disk segment, default 2
+	KeyIndexInterval int
+	// WriteStallSegments is the number of segments a table can have before BeginTX waits for the merger, default MaxSegments*10
+	WriteStallSegments int
+	// BloomBitsPerKey is the size of the bloom filter written with each segment, default 10 which gives a false
+	// positive rate of about 1%. a negative value writes segments without a filter
+	BloomBitsPerKey int
+	// Comparator orders the keys of a table, default BytewiseComparator. a table must always be opened with a
+	// Comparator of the same name as when it was created, otherwise its transactions return a *ComparatorError
+	Comparator Comparator
+	// MergeOperator applies the operands written by Transaction.Merge, default none which makes Merge fail. a table
+	// with operands that have not been applied must be opened with a MergeOperator that applies them the same way
+	MergeOperator MergeOperator
+
+	// Tables overrides the per table settings for the named tables
+	Tables map[string]TableOptions
+}
+
+// TableOptions overrides the database Options for a table. A zero value uses the database setting.
+type TableOptions struct {
+	MaxSegments        int
+	KeyBlockSize       int
+	KeyIndexInterval   int
+	WriteStallSegments int
+	BloomBitsPerKey    int
+	Comparator         Comparator
+	MergeOperator      MergeOperator
+}
+
+// the settings in effect for a table
+type tableOptions struct {
+	maxSegments        int
+	keyBlockSize       int
+	keyIndexInterval   int
+	writeStallSegments int
+	bloomBitsPerKey    int
+	comparator         Comparator
+	mergeOperator      MergeOperator
+}
+
+// the settings used to write and read a disk segment
+type segmentOptions struct {
+	blockSize        int
+	keyIndexInterval int
+	bloomBitsPerKey  int // no filter is written if not positive
+	// sync the files when written
+	sync bool
+	// the statistics updated by the filter checks, may be nil
+	stats *filterStats
+	// the cache of decoded key blocks, may be nil
+	cache *blockCache
+	// the order of the keys, bytewise if nil
+	cmp Comparator
+	// applies the merge operands when segments are merged, may be nil
+	merge MergeOperator
+}
+
+var defaultSegmentOptions = segmentOptions{blockSize: defaultKeyBlockSize, keyIndexInterval: defaultKeyIndexInterval, bloomBitsPerKey: defaultBloomBitsPerKey}
+
+// validates the options, returning a copy with the defaults applied
+func (options Options) withDefaults() (Options, error) {
+	if options.Durability < SyncNone || options.Durability > SyncOnCommit {
+		return options, errors.New(fmt.Sprint("invalid Durability ", options.Durability))
+	}
+	if options.Isolation < NoIsolation || options.Isolation > Serializable {
+		return options, errors.New(fmt.Sprint("invalid Isolation ", options.Isolation))
+	}
+	if options.MergeInterval < 0 {
+		return options, errors.New(fmt.Sprint("invalid MergeInterval ", options.MergeInterval))
+	}
+	if options.MergeInterval == 0 {
+		options.MergeInterval = defaultMergeInterval
+	}
+	if options.BlockCacheSize == 0 {
+		options.BlockCacheSize = defaultBlockCacheSize
+	}
+
+	defaults := TableOptions{
+		MaxSegments:      defaultMaxSegments,
+		KeyBlockSize:     defaultKeyBlockSize,
+		KeyIndexInterval: defaultKeyIndexInterval,
+		BloomBitsPerKey:  defaultBloomBitsPerKey,
+		Comparator:       BytewiseComparator}
+	table, err := options.tableDefaults().resolve(defaults)
+	if err != nil {
+		return options, err
+	}
+	// WriteStallSegments is left as is, so that when it is not set it follows the MaxSegments of each table
+	options.MaxSegments = table.maxSegments
+	options.KeyBlockSize = table.keyBlockSize
+	options.KeyIndexInterval = table.keyIndexInterval
+	options.BloomBitsPerKey = table.bloomBitsPerKey
+	options.Comparator = table.comparator
+
+	tables := make(map[string]TableOptions)
+	for name, t := range options.Tables {
+		if _, err := t.resolve(options.tableDefaults()); err != nil {
+			return options, errors.New("table " + name + ": " + err.Error())
+		}
+		tables[name] = t
+	}
+	options.Tables = tables
+
+	return options, nil
+}
+
+func (options Options) tableDefaults() TableOptions {
+	return TableOptions{
+		MaxSegments:        options.MaxSegments,
+		KeyBlockSize:       options.KeyBlockSize,
+		KeyIndexInterval:   options.KeyIndexInterval,
+		WriteStallSegments: options.WriteStallSegments,
+		BloomBitsPerKey:    options.BloomBitsPerKey,
+		Comparator:         options.Comparator,
+		MergeOperator:      options.MergeOperator}
+}
+
+// returns the settings for a table, options must have the defaults applied
+func (options Options) forTable(name string) tableOptions {
+	table, _ := options.Tables[name].resolve(options.tableDefaults())
+	return table
+}
+
+// applies the defaults to the zero values and validates the result
+func (t TableOptions) resolve(defaults TableOptions) (tableOptions, error) {
+	var resolved tableOptions
+
+	if t.MaxSegments < 0 || t.KeyBlockSize < 0 || t.KeyIndexInterval < 0 || t.WriteStallSegments < 0 {
+		return resolved, errors.New("options other than BloomBitsPerKey cannot be negative")
+	}
+
+	resolved.maxSegments = t.MaxSegments
+	if resolved.maxSegments == 0 {
+		resolved.maxSegments = defaults.MaxSegments
+	}
+	resolved.keyBlockSize = t.KeyBlockSize
+	if resolved.keyBlockSize == 0 {
+		resolved.keyBlockSize = defaults.KeyBlockSize
+	}
+	resolved.keyIndexInterval = t.KeyIndexInterval
+	if resolved.keyIndexInterval == 0 {
+		resolved.keyIndexInterval = defaults.KeyIndexInterval
+	}
+	resolved.writeStallSegments = t.WriteStallSegments
+	if resolved.writeStallSegments == 0 {
+		resolved.writeStallSegments = defaults.WriteStallSegments
+	}
+	if resolved.writeStallSegments == 0 {
+		resolved.writeStallSegments = resolved.maxSegments * 10
+	}
+	resolved.bloomBitsPerKey = t.BloomBitsPerKey
+	if resolved.bloomBitsPerKey == 0 {
+		resolved.bloomBitsPerKey = defaults.BloomBitsPerKey
+	}
+	resolved.comparator = t.Comparator
+	if resolved.comparator == nil {
+		resolved.comparator = defaults.Comparator
+	}
+	resolved.mergeOperator = t.MergeOperator
+	if resolved.mergeOperator == nil {
+		resolved.mergeOperator = defaults.MergeOperator
+	}
+
+	if resolved.keyBlockSize < minKeyBlockSize || resolved.keyBlockSize > maxKeyBlockSize {
+		return resolved, errors.New(fmt.Sprint("invalid KeyBlockSize ", resolved.keyBlockSize, ", must be between ", minKeyBlockSize, " and ", maxKeyBlockSize))
+	}
+	if resolved.writeStallSegments < resolved.maxSegments {
+		return resolved, errors.New(fmt.Sprint("invalid WriteStallSegments ", resolved.writeStallSegments, ", must be at least MaxSegments ", resolved.maxSegments))
+	}
+	return resolved, nil
+}
+
+// returns the settings used to write segments for the table
+func (db *Database) segmentOptions(table string) segmentOptions {
+	t := db.options.forTable(table)
+	return segmentOptions{
+		blockSize:        t.keyBlockSize,
+		keyIndexInterval: t.keyIndexInterval,
+		bloomBitsPerKey:  t.bloomBitsPerKey,
+		sync:             db.durability() >= SyncOnSegmentWrite,
+		stats:            &db.filterStats,
+		cache:            db.cache,
+		cmp:              t.comparator,
+		merge:            t.mergeOperator}
+}
@@ -0,0 +1,152 @@
+package keydb
+
+import "encoding/binary"
+
+// Range is a range of keys for a lookup. a nil Lower or Upper is unbounded on that side, otherwise the bound is
+// inclusive unless ExcludeLower or ExcludeUpper is set. the bounds are compared using the Comparator of the table
+type Range struct {
+	Lower        []byte
+	Upper        []byte
+	ExcludeLower bool
+	ExcludeUpper bool
+}
+
+// PrefixRange returns the range of all keys starting with prefix. it relies on the keys being ordered bytewise, so
+// with a table that has a different Comparator the range does not hold the keys with the prefix
+func PrefixRange(prefix []byte) Range {
+	r := Range{Lower: prefix}
+	// the upper bound is the first key after every key with the prefix, which is the prefix with the last byte that
+	// can be incremented incremented. if every byte is 0xff there is no upper bound
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			upper := make([]byte, i+1)
+			copy(upper, prefix)
+			upper[i]++
+			r.Upper = upper
+			r.ExcludeUpper = true
+			break
+		}
+	}
+	return r
+}
+
+// returns true if the key is before the lower bound
+func (r Range) before(cmp Comparator, key []byte) bool {
+	if r.Lower == nil {
+		return false
+	}
+	if r.ExcludeLower {
+		return !lessKeys(cmp, r.Lower, key)
+	}
+	return lessKeys(cmp, key, r.Lower)
+}
+
+// returns true if the key is after the upper bound
+func (r Range) after(cmp Comparator, key []byte) bool {
+	if r.Upper == nil {
+		return false
+	}
+	if r.ExcludeUpper {
+		return !lessKeys(cmp, key, r.Upper)
+	}
+	return lessKeys(cmp, r.Upper, key)
+}
+
+func (r Range) contains(cmp Comparator, key []byte) bool {
+	return !r.before(cmp, key) && !r.after(cmp, key)
+}
+
+// returns the part of the range from key inclusive, a nil key is the whole range
+func (r Range) from(cmp Comparator, key []byte) Range {
+	if key == nil || r.before(cmp, key) {
+		return r
+	}
+	return Range{Lower: key, Upper: r.Upper, ExcludeUpper: r.ExcludeUpper}
+}
+
+// returns the part of the range up to key inclusive, a nil key is the whole range
+func (r Range) to(cmp Comparator, key []byte) Range {
+	if key == nil || r.after(cmp, key) {
+		return r
+	}
+	return Range{Lower: r.Lower, ExcludeLower: r.ExcludeLower, Upper: key}
+}
+
+// the flags of an encoded range
+const (
+	rangeHasLower     uint8 = 1
+	rangeHasUpper     uint8 = 2
+	rangeExcludeLower uint8 = 4
+	rangeExcludeUpper uint8 = 8
+)
+
+// appends the encoded range to buf, the format is
+// flags uint8
+// lowerlen uint16
+// lower []byte
+// upperlen uint16
+// upper []byte
+func appendRange(buf []byte, r Range) []byte {
+	var flags uint8
+	if r.Lower != nil {
+		flags |= rangeHasLower
+	}
+	if r.Upper != nil {
+		flags |= rangeHasUpper
+	}
+	if r.ExcludeLower {
+		flags |= rangeExcludeLower
+	}
+	if r.ExcludeUpper {
+		flags |= rangeExcludeUpper
+	}
+	buf = append(buf, flags)
+	var keylen [2]byte
+	for _, key := range [][]byte{r.Lower, r.Upper} {
+		binary.LittleEndian.PutUint16(keylen[:], uint16(len(key)))
+		buf = append(buf, keylen[:]...)
+		buf = append(buf, key...)
+	}
+	return buf
+}
+
+// decodes a range encoded by appendRange, returning the remaining bytes. the bounds are copied
+func decodeRange(buf []byte) (Range, []byte, bool) {
+	var r Range
+	if len(buf) < 1 {
+		return r, nil, false
+	}
+	flags := buf[0]
+	buf = buf[1:]
+	var keys [2][]byte
+	for i := range keys {
+		if len(buf) < 2 {
+			return r, nil, false
+		}
+		keylen := int(binary.LittleEndian.Uint16(buf))
+		if len(buf) < 2+keylen {
+			return r, nil, false
+		}
+		keys[i] = append([]byte{}, buf[2:2+keylen]...)
+		buf = buf[2+keylen:]
+	}
+	if flags&rangeHasLower != 0 {
+		r.Lower = keys[0]
+	}
+	if flags&rangeHasUpper != 0 {
+		r.Upper = keys[1]
+	}
+	r.ExcludeLower = flags&rangeExcludeLower != 0
+	r.ExcludeUpper = flags&rangeExcludeUpper != 0
+	return r, buf, true
+}
+
+// returns true if any of the ranges contains the key
+func rangesContain(ranges []Range, cmp Comparator, key []byte) bool {
+	for _, r := range ranges {
+		if r.contains(cmp, key) {
+			return true
+		}
+	}
+	return false
+}
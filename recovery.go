@@ -0,0 +1,168 @@
+package keydb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// recoverSegmentFiles removes the temporary files left behind by a crash, so that an interrupted segment write or
+// merge never leaves the database unopenable. it returns a description of every change made
+//
+// segments are written to .tmp files, then the key file and the data file are renamed in that order, so a data .tmp
+// file whose key file was already renamed is complete and the rename is finished, and any other .tmp file is removed.
+// whether the segment is used is decided by the manifest
+func recoverSegmentFiles(path string) ([]string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []string
+
+	names := make(map[string]bool)
+	for _, f := range infos {
+		names[f.Name()] = true
+	}
+
+	// leftover temporary files
+	for _, f := range infos {
+		name := f.Name()
+		if !strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		final := strings.TrimSuffix(name, ".tmp")
+		if keyName := replaceLast(final, ".data.", ".keys."); keyName != final && names[keyName] && !names[final] {
+			err := os.Rename(filepath.Join(path, name), filepath.Join(path, final))
+			if err != nil {
+				return report, err
+			}
+			names[final] = true
+			report = append(report, fmt.Sprint("completed interrupted write of ", final))
+		} else {
+			err := os.Remove(filepath.Join(path, name))
+			if err == nil && strings.Contains(final, ".keys.") {
+				// the filter is written before the key file is renamed
+				err = removeBloomFilter(filepath.Join(path, final))
+			}
+			if err != nil {
+				return report, err
+			}
+			report = append(report, fmt.Sprint("removed temporary file ", name))
+		}
+	}
+
+	return report, nil
+}
+
+// recoverLegacySegments repairs the segment files of a database without a manifest, where the live segments are
+// inferred from the directory listing. a merge renames the merged segment into place and then removes its source
+// segments, so a segment whose id range is contained in the range of a merged segment was a source of an interrupted
+// merge and is removed
+func recoverLegacySegments(path string) ([]string, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var report []string
+
+	names := make(map[string]bool)
+	for _, f := range infos {
+		names[f.Name()] = true
+	}
+
+	// key or data files without their partner, left by an interrupted removal
+	var keyFiles []string
+	for name := range names {
+		var partner string
+		if strings.Contains(name, ".keys.") {
+			partner = replaceLast(name, ".keys.", ".data.")
+		} else if strings.Contains(name, ".data.") {
+			partner = replaceLast(name, ".data.", ".keys.")
+		} else {
+			continue
+		}
+		if names[partner] {
+			if strings.Contains(name, ".keys.") {
+				keyFiles = append(keyFiles, name)
+			}
+			continue
+		}
+		err := os.Remove(filepath.Join(path, name))
+		if err == nil && strings.Contains(name, ".keys.") {
+			err = removeBloomFilter(filepath.Join(path, name))
+		}
+		if err != nil {
+			return report, err
+		}
+		report = append(report, fmt.Sprint("removed incomplete segment file ", name))
+	}
+
+	// source segments of interrupted merges
+	type segmentRange struct {
+		keyName string
+		low, id uint64
+		merged  bool
+	}
+	tables := make(map[string][]segmentRange)
+	for _, name := range keyFiles {
+		low, id := getSegmentRange(name)
+		table := getTableName(name)
+		merged := strings.Contains(name, ".merged.")
+		tables[table] = append(tables[table], segmentRange{keyName: name, low: low, id: id, merged: merged})
+	}
+
+	for _, segments := range tables {
+		sort.Slice(segments, func(i, j int) bool {
+			return segments[i].keyName < segments[j].keyName
+		})
+		for _, s := range segments {
+			for _, m := range segments {
+				if !m.merged || m.keyName == s.keyName || m.low > s.low || s.id > m.id {
+					continue
+				}
+				if m.low == s.low && m.id == s.id && s.merged {
+					// without the low id of older merges it is not known which one replaced the other
+					continue
+				}
+				err0 := os.Remove(filepath.Join(path, s.keyName))
+				err1 := os.Remove(filepath.Join(path, replaceLast(s.keyName, ".keys.", ".data.")))
+				err2 := removeBloomFilter(filepath.Join(path, s.keyName))
+				if err := errn(err0, err1, err2); err != nil {
+					return report, err
+				}
+				report = append(report, fmt.Sprint("completed interrupted merge into ", m.keyName, ", removed ", s.keyName))
+				break
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// returns the table a segment file belongs to
+func getTableName(filename string) string {
+	base := filepath.Base(filename)
+	if index := strings.Index(base, ".merged."); index >= 0 {
+		return base[:index]
+	}
+	if index := strings.Index(base, ".keys."); index >= 0 {
+		return base[:index]
+	}
+	if index := strings.Index(base, ".data."); index >= 0 {
+		return base[:index]
+	}
+	return base
+}
+
+func replaceLast(s, old, new string) string {
+	index := strings.LastIndex(s, old)
+	if index < 0 {
+		return s
+	}
+	return s[:index] + new + s[index+len(old):]
+}
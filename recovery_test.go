@@ -0,0 +1,80 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// writes a segment with a single key in the format used before segments were versioned, which is the format
+// assumed for the segments of a database without a manifest
+func writeTestSegment(t *testing.T, keyFilename, dataFilename string, key, value string) {
+	block := make([]byte, defaultKeyBlockSize)
+	binary.LittleEndian.PutUint16(block, uint16(len(key)))
+	copy(block[2:], key)
+	binary.LittleEndian.PutUint64(block[2+len(key):], 0)
+	binary.LittleEndian.PutUint32(block[2+len(key)+8:], uint32(len(value)))
+	binary.LittleEndian.PutUint16(block[2+len(key)+12:], endOfBlock)
+
+	err0 := ioutil.WriteFile(keyFilename, block, os.ModePerm)
+	err1 := ioutil.WriteFile(dataFilename, []byte(value), os.ModePerm)
+	if err := errn(err0, err1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverSegmentFiles(t *testing.T) {
+	path := "test/recoverdb"
+	os.RemoveAll(path)
+	os.MkdirAll(path, os.ModePerm)
+
+	writeTestSegment(t, path+"/main.keys.1", path+"/main.data.1", "mykey", "myvalue1")
+	writeTestSegment(t, path+"/main.keys.2", path+"/main.data.2", "mykey", "myvalue2")
+
+	// a merge that renamed its output but did not remove its sources
+	writeTestSegment(t, path+"/main.merged.1.1.keys.2", path+"/main.merged.1.1.data.2", "mykey", "myvalue2")
+
+	// a segment write that never completed
+	writeTestSegment(t, path+"/main.keys.3.tmp", path+"/main.data.3.tmp", "mykey3", "myvalue3")
+
+	// a segment write interrupted between the renames
+	writeTestSegment(t, path+"/main.keys.4", path+"/main.data.4.tmp", "mykey4", "myvalue4")
+
+	db, err := Open(path, false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if len(db.RecoveryReport()) != 5 {
+		t.Fatal("incorrect recovery report", db.RecoveryReport())
+	}
+
+	for _, name := range []string{"main.keys.1", "main.data.2", "main.keys.3.tmp", "main.data.4.tmp"} {
+		if _, err := os.Stat(path + "/" + name); err == nil {
+			t.Fatal("file should of been removed", name)
+		}
+	}
+
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	value, err := tx.Get([]byte("mykey"))
+	if err != nil || string(value) != "myvalue2" {
+		t.Fatal("incorrect value for merged key", string(value), err)
+	}
+	_, err = tx.Get([]byte("mykey3"))
+	if err != KeyNotFound {
+		t.Fatal("key from incomplete segment should not be found", err)
+	}
+	value, err = tx.Get([]byte("mykey4"))
+	if err != nil || string(value) != "myvalue4" {
+		t.Fatal("incorrect value for completed segment", string(value), err)
+	}
+	tx.Commit()
+
+	err = db.CloseWithMerge(0)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
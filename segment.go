@@ -5,7 +5,22 @@ package keydb
 type segment interface {
 	Put(key []byte, value []byte) error
 	Get(key []byte) ([]byte, error)
+	// GetEntry is like Get, and also returns true if the value is a list of merge operands, see appendOperand
+	GetEntry(key []byte) (value []byte, operands bool, err error)
+	// PutOperands sets the value of the key to a list of merge operands
+	PutOperands(key []byte, operands []byte) error
+	// PutExpiring puts a value that expires at the time in unix nanoseconds, see Transaction.PutWithTTL
+	PutExpiring(key []byte, value []byte, expires int64) error
 	Remove(key []byte) ([]byte, error)
 	Lookup(lower []byte, upper []byte) (LookupIterator, error)
+	// LookupReverse is like Lookup, but the iterator returns the keys in descending order
+	LookupReverse(lower []byte, upper []byte) (LookupIterator, error)
+	// LookupRange returns the keys in the range, in descending order if reverse is true
+	LookupRange(r Range, reverse bool) (LookupIterator, error)
+	// RemoveRange removes every key in the range, see Transaction.RemoveRange
+	RemoveRange(r Range) error
+	// RangeTombstones returns the ranges removed in the segment, which hide the keys of older segments but not the
+	// keys of the segment itself
+	RangeTombstones() []Range
 	Close() error
 }
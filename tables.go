@@ -0,0 +1,170 @@
+package keydb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ListTables returns the names of the tables in the database, in order. a table exists once a transaction has been
+// started on it, until it is dropped
+func (db *Database) ListTables() ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.err != nil {
+		return nil, db.err
+	}
+	if db.closing {
+		return nil, DatabaseClosed
+	}
+	return db.manifest.tableNames(), nil
+}
+
+// DropTable removes a table and all of its records. it waits for the open write transactions on the table to
+// complete, and for the committed segments to be written. read only transactions and iterators on the table
+// continue to read their snapshot, and the segment files are removed when they complete
+func (db *Database) DropTable(table string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	it, err := db.quiesceTable(table)
+	if err != nil {
+		return err
+	}
+	defer it.merge.Unlock()
+
+	changes := []manifestChange{{op: dropTable, table: table}}
+	for _, info := range db.manifest.segments(table) {
+		changes = append(changes, manifestChange{op: removeSegment, table: table, info: info})
+	}
+	if err := db.manifest.apply(changes, true); err != nil {
+		return err
+	}
+
+	return db.unloadTable(it)
+}
+
+// RenameTable renames a table. like DropTable it waits for the open write transactions on the table to complete.
+// the table keeps the comparator it was created with, so the Comparator in the options for the new name must match
+func (db *Database) RenameTable(table string, newName string) error {
+	if newName == "" || strings.ContainsAny(newName, "./\\") {
+		return InvalidTableName
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	it, err := db.quiesceTable(table)
+	if err != nil {
+		return err
+	}
+	defer it.merge.Unlock()
+
+	if db.manifest.comparator(newName) != "" {
+		return TableExists
+	}
+	expected, actual := db.manifest.comparator(table), db.options.forTable(newName).comparator.Name()
+	if expected != actual {
+		return &ComparatorError{Table: newName, Expected: expected, Actual: actual}
+	}
+
+	// the files are linked under the new name, and the old names are removed once the manifest no longer refers to
+	// them. a crash before the manifest edit leaves the new names unreferenced, and they are removed on open
+	changes := []manifestChange{{op: dropTable, table: table}, {op: setComparator, table: newName, comparator: expected}}
+	var linked []string
+	link := func(from, to string) error {
+		err := os.Link(filepath.Join(db.path, from), filepath.Join(db.path, to))
+		if err == nil {
+			linked = append(linked, filepath.Join(db.path, to))
+		}
+		return err
+	}
+	for _, info := range db.manifest.segments(table) {
+		renamed := info
+		renamed.keyFile = newName + info.keyFile[len(table):]
+		renamed.dataFile = newName + info.dataFile[len(table):]
+
+		err0 := link(info.keyFile, renamed.keyFile)
+		err1 := link(info.dataFile, renamed.dataFile)
+		// the bloom filter is optional
+		err2 := link(bloomFilename(info.keyFile), bloomFilename(renamed.keyFile))
+		if os.IsNotExist(err2) {
+			err2 = nil
+		}
+		if err := errn(err0, err1, err2); err != nil {
+			for _, name := range linked {
+				os.Remove(name)
+			}
+			return err
+		}
+
+		changes = append(changes,
+			manifestChange{op: removeSegment, table: table, info: info},
+			manifestChange{op: addSegment, table: newName, info: renamed})
+	}
+	if err := syncDir(db.path); err != nil {
+		return err
+	}
+	if err := db.manifest.apply(changes, true); err != nil {
+		return err
+	}
+
+	return db.unloadTable(it)
+}
+
+// waits until the table has no open write transactions, no segments waiting to be written and is not being merged,
+// returning it with the merge lock held. the database must be locked, and stays locked
+func (db *Database) quiesceTable(table string) (*internalTable, error) {
+	for {
+		if db.err != nil {
+			return nil, db.err
+		}
+		if db.closing {
+			return nil, DatabaseClosed
+		}
+		if db.manifest.comparator(table) == "" {
+			return nil, TableNotFound
+		}
+		it, err := db.getTable(table)
+		if err != nil {
+			return nil, err
+		}
+
+		it.Lock()
+		busy := it.transactions > 0
+		for _, s := range it.segments {
+			if _, ok := s.(*diskSegment); !ok {
+				busy = true
+			}
+		}
+		it.Unlock()
+
+		// the merger does not need the database lock to finish a merge, so it cannot be waiting for this routine
+		if !busy {
+			it.merge.Lock()
+			return it, nil
+		}
+
+		db.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		db.Lock()
+	}
+}
+
+// discards a dropped or renamed table, the segment files are removed once no read only transaction is using them.
+// the database must be locked, and the merge lock held
+func (db *Database) unloadTable(it *internalTable) error {
+	it.dropped = true
+	delete(db.tables, it.name)
+
+	var errs []error
+	for _, s := range it.segments {
+		if ds, ok := s.(*diskSegment); ok {
+			errs = append(errs, ds.removeWhenReleased())
+		}
+	}
+	it.segments = nil
+	return errn(errs...)
+}
@@ -2,6 +2,7 @@ package keydb
 
 import (
 	"errors"
+	"math"
 	"sync/atomic"
 	"time"
 )
@@ -17,6 +18,14 @@ type Transaction struct {
 	id     uint64
 	multi  *multiSegment
 	memory segment
+	// a read only transaction holds a reference to the disk segments of its snapshot
+	readOnly bool
+	pinned   []*diskSegment
+	// the table commitSeq when the transaction began, and the keys read if the database is Serializable
+	startSeq uint64
+	reads    *readSet
+	// non-nil if the transaction is part of a multi table transaction, which must be used to complete it
+	parent *MultiTransaction
 }
 
 type transactionLookup struct {
@@ -48,6 +57,8 @@ func (db *Database) BeginTX(table string) (*Transaction, error) {
 	db.Lock()
 	defer db.Unlock()
 
+	db.waitForQuiesce()
+
 	if db.err != nil {
 		return nil, db.err
 	}
@@ -56,39 +67,174 @@ func (db *Database) BeginTX(table string) (*Transaction, error) {
 		return nil, DatabaseClosed
 	}
 
-	it, ok := db.tables[table]
-	if !ok {
-		// 从指定目录读取{table}事务的key/value文件(如果有的话)，并恢复为内存表internalTable
-		it = &internalTable{name: table, segments: loadDiskSegments(db.path, table)}
-		db.tables[table] = it
+	it, err := db.getTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	db.waitForMerges(it)
+
+	return db.beginTX0(it), nil
+}
+
+// wait to start a write transaction while a Checkpoint or Backup waits for the open ones to complete. the database
+// must be locked
+func (db *Database) waitForQuiesce() {
+	for atomic.LoadInt32(&db.quiescing) > 0 {
+		db.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		db.Lock()
 	}
+}
 
-	for { // wait to start transaction if table has too many segments
-		if len(it.segments) > maxSegments*10 {
+// wait to start transaction if a table has too many segments. the database must be locked
+func (db *Database) waitForMerges(tables ...*internalTable) {
+	for _, it := range tables {
+		for it.segmentCount() > it.options.writeStallSegments {
 			db.Unlock()
 			time.Sleep(100 * time.Millisecond)
 			db.Lock()
-		} else {
-			break
 		}
 	}
+}
+
+// returns the number of segments, which a segment write or merge changes without the database lock
+func (it *internalTable) segmentCount() int {
+	it.Lock()
+	defer it.Unlock()
+	return len(it.segments)
+}
 
+// starts a write transaction on the table. the database must be locked
+func (db *Database) beginTX0(it *internalTable) *Transaction {
 	it.Lock()
 	defer it.Unlock()
 	it.transactions++
 
-	tx := &Transaction{db: db, table: table, open: true}
+	tx := &Transaction{db: db, table: it.name, open: true}
 	tx.id = atomic.AddUint64(&txID, 1)
 
-	tx.memory = newMemorySegment()
+	tx.startSeq = it.commitSeq
+	it.active[tx.id] = tx.startSeq
+	if db.options.Isolation == Serializable {
+		tx.reads = &readSet{}
+	}
+
+	tx.memory = newMemorySegmentWith(it.options.comparator)
+
+	// copied, since a commit may append to the table segments
+	segments := make([]segment, len(it.segments), len(it.segments)+1)
+	copy(segments, it.segments)
+	tx.multi = newMultiSegmentWith(append(segments, tx.memory), it.options.comparator)
+	tx.multi.merge = it.options.mergeOperator
+
+	db.transactions[tx.id] = tx
+
+	return tx
+}
+
+// BeginReadTX starts a read only transaction for a database table. the transaction reads a snapshot of the table
+// as of the start of the transaction, and does not delay merges, so it is suitable for long running scans. the
+// segment files replaced by a merge are kept until the last transaction reading them completes.
+// Put and Remove return ReadOnlyTransaction. the transaction should be completed with either Commit, or Rollback
+func (db *Database) BeginReadTX(table string) (*Transaction, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.err != nil {
+		return nil, db.err
+	}
+
+	if db.closing {
+		return nil, DatabaseClosed
+	}
+
+	it, err := db.getTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	it.Lock()
+	defer it.Unlock()
+
+	tx := &Transaction{db: db, table: table, open: true, readOnly: true}
+	tx.id = atomic.AddUint64(&txID, 1)
 
-	tx.multi = newMultiSegment(append(it.segments, tx.memory))
+	// committed memory segments are not modified, so only the disk segments need to be pinned
+	snapshot := make([]segment, len(it.segments))
+	copy(snapshot, it.segments)
+	for _, s := range snapshot {
+		if ds, ok := s.(*diskSegment); ok {
+			ds.acquire()
+			tx.pinned = append(tx.pinned, ds)
+		}
+	}
+	tx.multi = newMultiSegmentWith(snapshot, it.options.comparator)
+	tx.multi.merge = it.options.mergeOperator
 
 	db.transactions[tx.id] = tx
 
 	return tx, nil
 }
 
+// returns the table, loading its segments if this is the first transaction for the table, or a *ComparatorError if
+// the table was created with another comparator. the comparator of a new table is recorded in the manifest. the
+// database must be locked
+func (db *Database) getTable(table string) (*internalTable, error) {
+	if err := db.checkComparator(table); err != nil {
+		return nil, err
+	}
+	it, ok := db.tables[table]
+	if !ok {
+		options := db.options.forTable(table)
+		if db.manifest.comparator(table) == "" {
+			change := manifestChange{op: setComparator, table: table, comparator: options.comparator.Name()}
+			if err := db.manifest.apply([]manifestChange{change}, true); err != nil {
+				return nil, err
+			}
+		}
+		// 从指定目录读取{table}事务的key/value文件(如果有的话)，并恢复为内存表internalTable
+		segments, err := loadDiskSegments(db.path, db.manifest.segments(table), db.segmentOptions(table))
+		if err != nil {
+			return nil, err
+		}
+		it = &internalTable{name: table, options: options, segments: segments}
+		it.active = make(map[uint64]uint64)
+		db.tables[table] = it
+	}
+	return it, nil
+}
+
+// the segments of a table are ordered by its comparator, so they cannot be read with a different one. the other
+// tables of the database can still be used
+func (db *Database) checkComparator(table string) error {
+	expected, actual := db.manifest.comparator(table), db.options.forTable(table).comparator.Name()
+	if expected != "" && expected != actual {
+		return &ComparatorError{Table: table, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// completes a read only transaction, releasing its snapshot
+func (tx *Transaction) closeReadOnly() error {
+	tx.db.Lock()
+	if !tx.open {
+		tx.db.Unlock()
+		return TransactionClosed
+	}
+	delete(tx.db.transactions, tx.id)
+	tx.open = false
+	tx.multi = nil
+	tx.db.Unlock()
+
+	var errs []error
+	for _, ds := range tx.pinned {
+		errs = append(errs, ds.release())
+	}
+	tx.pinned = nil
+	return errn(errs...)
+}
+
 // Get a value for a key, error is non-nil if the key was not found or an error occurred
 func (tx *Transaction) Get(key []byte) (value []byte, err error) {
 	if !tx.open {
@@ -97,6 +243,9 @@ func (tx *Transaction) Get(key []byte) (value []byte, err error) {
 	if len(key) > 1024 {
 		return nil, KeyTooLong
 	}
+	if tx.reads != nil {
+		tx.reads.addKey(key)
+	}
 	value, err = tx.multi.Get(key)
 	if err != nil {
 		return nil, err
@@ -112,6 +261,9 @@ func (tx *Transaction) Put(key []byte, value []byte) error {
 	if !tx.open {
 		return TransactionClosed
 	}
+	if tx.readOnly {
+		return ReadOnlyTransaction
+	}
 	if len(key) > 1024 {
 		return KeyTooLong
 	}
@@ -121,11 +273,79 @@ func (tx *Transaction) Put(key []byte, value []byte) error {
 	return tx.memory.Put(key, value)
 }
 
+// PutWithTTL puts a key/value pair into the table like Put, and the key is removed once the ttl has elapsed. an
+// expired key is not returned by Get or Lookup, and its value is dropped when the segment holding it is merged.
+// the value of a key merged with Merge after the Put does not expire. a ttl too long to represent never expires.
+func (tx *Transaction) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if !tx.open {
+		return TransactionClosed
+	}
+	if tx.readOnly {
+		return ReadOnlyTransaction
+	}
+	if len(key) > 1024 {
+		return KeyTooLong
+	}
+	if len(key) == 0 {
+		return EmptyKey
+	}
+	if ttl <= 0 {
+		return InvalidTTL
+	}
+	expires := nowNanos() + int64(ttl)
+	if expires < 0 {
+		// the expiry is past the latest time that can be represented, so the key never expires
+		expires = math.MaxInt64
+	}
+	return tx.memory.PutExpiring(key, value, expires)
+}
+
+// Merge adds an operand to the value of a key, which is applied by the MergeOperator of the table when the key is
+// read, without reading the value now. the operands of a key are applied in the order they were merged, and an
+// operand merged after a Put or Remove in the same transaction is applied immediately. empty keys are not supported.
+func (tx *Transaction) Merge(key []byte, operand []byte) error {
+	if !tx.open {
+		return TransactionClosed
+	}
+	if tx.readOnly {
+		return ReadOnlyTransaction
+	}
+	if len(key) > 1024 {
+		return KeyTooLong
+	}
+	if len(key) == 0 {
+		return EmptyKey
+	}
+	merge := tx.multi.merge
+	if merge == nil {
+		return NoMergeOperator
+	}
+	value, operands, err := tx.memory.GetEntry(key)
+	if err == KeyNotFound {
+		return tx.memory.PutOperands(key, appendOperand(nil, operand))
+	}
+	if err != nil {
+		return err
+	}
+	if operands {
+		// copied, since a committed transaction may still be reading the list
+		return tx.memory.PutOperands(key, appendOperand(append([]byte(nil), value...), operand))
+	}
+	value, err = merge.Merge(key, value, [][]byte{operand})
+	if err != nil {
+		return err
+	}
+	return tx.memory.Put(key, value)
+}
+
 // Remove a key and its value from the table. empty keys are not supported.
 func (tx *Transaction) Remove(key []byte) ([]byte, error) {
 	if !tx.open {
 		return nil, TransactionClosed
 	}
+	if tx.readOnly {
+		return nil, ReadOnlyTransaction
+	}
 	if len(key) > 1024 {
 		return nil, KeyTooLong
 	}
@@ -137,22 +357,81 @@ func (tx *Transaction) Remove(key []byte) ([]byte, error) {
 	return value, nil
 }
 
+// RemoveRange removes every key between lower and upper inclusive. lower or upper can be nil and then the range is
+// unbounded on that side. unlike Remove the keys are not read, a single range tombstone is written which hides the
+// keys of the older segments, and the merger drops it once it has been merged with the oldest segment
+func (tx *Transaction) RemoveRange(lower []byte, upper []byte) error {
+	if !tx.open {
+		return TransactionClosed
+	}
+	if tx.readOnly {
+		return ReadOnlyTransaction
+	}
+	if len(lower) > 1024 || len(upper) > 1024 {
+		return KeyTooLong
+	}
+	return tx.memory.RemoveRange(Range{Lower: lower, Upper: upper})
+}
+
 // Lookup finds matching record between lower and upper inclusive. lower or upper can be nil and
 // and then the range is unbounded on that side. Using the iterator after the transaction has
 // been Commit/Rollback is not supported.
 func (tx *Transaction) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
+	return tx.LookupRange(Range{Lower: lower, Upper: upper})
+}
+
+// LookupReverse is like Lookup, but the iterator returns the matching records in descending key order, starting from
+// upper. for example the latest entries before a time are found with a nil lower and the time as upper
+func (tx *Transaction) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	return tx.LookupRangeReverse(Range{Lower: lower, Upper: upper})
+}
+
+// LookupPrefix finds the records with keys starting with prefix. the keys with a prefix are only contiguous if the
+// table is ordered by BytewiseComparator, otherwise PrefixRequiresBytewise is returned
+func (tx *Transaction) LookupPrefix(prefix []byte) (LookupIterator, error) {
+	if !tx.open {
+		return nil, TransactionClosed
+	}
+	if cmp := tx.multi.cmp; cmp != nil && cmp.Name() != BytewiseComparator.Name() {
+		return nil, PrefixRequiresBytewise
+	}
+	return tx.LookupRange(PrefixRange(prefix))
+}
+
+// LookupRange finds the records with keys in the range, see Lookup
+func (tx *Transaction) LookupRange(r Range) (LookupIterator, error) {
+	return tx.lookup(r, false)
+}
+
+// LookupRangeReverse finds the records with keys in the range in descending key order, see LookupReverse
+func (tx *Transaction) LookupRangeReverse(r Range) (LookupIterator, error) {
+	return tx.lookup(r, true)
+}
+
+func (tx *Transaction) lookup(r Range, reverse bool) (LookupIterator, error) {
 	if !tx.open {
 		return nil, TransactionClosed
 	}
-	itr, err := tx.multi.Lookup(lower, upper)
+	if tx.reads != nil {
+		tx.reads.addRange(r.Lower, r.Upper)
+	}
+	itr, err := tx.multi.LookupRange(r, reverse)
 	if err != nil {
 		return nil, err
 	}
 	return &transactionLookup{itr}, nil
 }
 
-// Commit persists any changes to the table. after Commit the transaction can no longer be used
+// Commit persists any changes to the table. the changes are recorded in the write-ahead log before Commit returns,
+// and the disk segment is written in the background. if the transaction conflicts with another transaction it is
+// rolled back and a *ConflictError is returned, see Isolation. after Commit the transaction can no longer be used
 func (tx *Transaction) Commit() error {
+	if tx.parent != nil {
+		return PartOfMultiTransaction
+	}
+	if tx.readOnly {
+		return tx.closeReadOnly()
+	}
 	tx.db.Lock()
 	delete(tx.db.transactions, tx.id)
 	table := tx.db.tables[tx.table]
@@ -163,12 +442,29 @@ func (tx *Transaction) Commit() error {
 	defer table.Unlock()
 
 	table.transactions--
+
+	isolation := tx.db.options.Isolation
+	writes, err := table.checkCommit(tx, isolation)
+	if err != nil {
+		table.abortCommit(tx)
+		return err
+	}
+
+	// the segment is logged before it becomes visible, so the commit survives a crash. the writes are only recorded
+	// once logged, so a failed commit cannot conflict with later transactions
+	id := tx.db.nextSegmentID()
+	err = tx.db.wal.logSegment(id, tx.table, tx.memory, tx.db.durability() >= SyncOnCommit)
+	if err != nil {
+		table.abortCommit(tx)
+		return err
+	}
+	table.recordCommit(tx, writes, isolation)
 	table.segments = append(table.segments, tx.memory)
 
 	tx.db.wg.Add(1)
 
 	go func() {
-		err := writeSegmentToDisk(tx.db, tx.table, tx.memory)
+		err := writeSegmentToDisk(tx.db, table, id, tx.memory)
 		if err != nil {
 			tx.db.Lock()
 			tx.db.err = errors.New("transaction failed: " + err.Error())
@@ -179,9 +475,16 @@ func (tx *Transaction) Commit() error {
 	return nil
 }
 
-// CommitSync persists any changes to the table, waiting for disk segment to be written. note that synchronous writes are not used,
-// so that a hard OS failure could leave the database in a corrupted state. after Commit the transaction can no longer be used
+// CommitSync persists any changes to the table, waiting for disk segment to be written. the segment files are only synced
+// to stable storage if the database Durability is SyncOnSegmentWrite or higher, otherwise a hard OS failure could leave the
+// database in a corrupted state. after Commit the transaction can no longer be used
 func (tx *Transaction) CommitSync() error {
+	if tx.parent != nil {
+		return PartOfMultiTransaction
+	}
+	if tx.readOnly {
+		return tx.closeReadOnly()
+	}
 	tx.db.Lock()
 	delete(tx.db.transactions, tx.id)
 	table := tx.db.tables[tx.table]
@@ -198,19 +501,42 @@ func (tx *Transaction) CommitSync() error {
 	table.Lock()
 
 	table.transactions--
+
+	isolation := tx.db.options.Isolation
+	writes, err := table.checkCommit(tx, isolation)
+	if err != nil {
+		table.abortCommit(tx)
+		table.Unlock()
+		return err
+	}
+
+	id := tx.db.nextSegmentID()
+	err = tx.db.wal.logSegment(id, tx.table, tx.memory, tx.db.durability() >= SyncOnCommit)
+	if err != nil {
+		table.abortCommit(tx)
+		table.Unlock()
+		return err
+	}
+	table.recordCommit(tx, writes, isolation)
 	table.segments = append(table.segments, tx.memory)
 
 	tx.db.wg.Add(1)
 
 	table.Unlock()
 
-	err = writeSegmentToDisk(tx.db, tx.table, tx.memory)
+	err = writeSegmentToDisk(tx.db, table, id, tx.memory)
 
 	return err
 }
 
 // Rollback discards any changes to the table. after Rollback the transaction can no longer be used
 func (tx *Transaction) Rollback() error {
+	if tx.parent != nil {
+		return PartOfMultiTransaction
+	}
+	if tx.readOnly {
+		return tx.closeReadOnly()
+	}
 	tx.db.Lock()
 	defer tx.db.Unlock()
 
@@ -224,6 +550,7 @@ func (tx *Transaction) Rollback() error {
 
 	defer table.Unlock()
 	table.transactions--
+	table.abortCommit(tx)
 
 	return nil
 }
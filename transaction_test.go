@@ -0,0 +1,274 @@
+package keydb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadTransaction(t *testing.T) {
+	path := "test/readdb"
+	Remove(path)
+
+	db, err := OpenWithOptions(path, Options{CreateIfNeeded: true, MaxSegments: 1, MergeInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 4; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	rtx, err := db.BeginReadTX("main")
+	if err != nil {
+		t.Fatal("unable to create read transaction", err)
+	}
+	if err = rtx.Put([]byte("mykey"), []byte("myvalue")); err != ReadOnlyTransaction {
+		t.Fatal("read transaction should not allow Put", err)
+	}
+	pinned := rtx.pinned
+
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey4"), []byte("myvalue4"))
+	if err = tx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	// the merge is not blocked by the read transaction
+	for start := time.Now(); ; {
+		db.tables["main"].Lock()
+		n := len(db.tables["main"].segments)
+		db.tables["main"].Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("segments were not merged, count is", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, ds := range pinned {
+		if _, err := os.Stat(ds.keyFile.Name()); err != nil {
+			t.Fatal("segment file should be kept until the read transaction completes", err)
+		}
+	}
+
+	if _, err = rtx.Get([]byte("mykey4")); err != KeyNotFound {
+		t.Fatal("read transaction should not see later commits", err)
+	}
+	itr, err := rtx.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal("unable to lookup", err)
+	}
+	count := 0
+	for {
+		_, _, err := itr.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 4 {
+		t.Fatal("incorrect count", count)
+	}
+	if err = rtx.Commit(); err != nil {
+		t.Fatal("unable to complete read transaction", err)
+	}
+
+	for _, ds := range pinned {
+		if _, err := os.Stat(ds.keyFile.Name()); err == nil {
+			t.Fatal("merged segment file should be removed", ds.keyFile.Name())
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	path := "test/conflictdb"
+	Remove(path)
+
+	db, err := OpenWithOptions(path, Options{CreateIfNeeded: true, Isolation: Serializable})
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	tx1, _ := db.BeginTX("main")
+	tx2, _ := db.BeginTX("main")
+	tx3, _ := db.BeginTX("main")
+	tx4, _ := db.BeginTX("main")
+
+	tx1.Put([]byte("mykey"), []byte("myvalue1"))
+	tx2.Put([]byte("mykey"), []byte("myvalue2"))
+	tx3.Get([]byte("mykey"))
+	tx3.Put([]byte("otherkey"), []byte("othervalue"))
+	tx4.Lookup([]byte("a"), []byte("b"))
+	tx4.Put([]byte("otherkey2"), []byte("othervalue"))
+
+	if err = tx1.Commit(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	if err, ok := tx2.Commit().(*ConflictError); !ok || string(err.Key) != "mykey" {
+		t.Fatal("write should of conflicted", err)
+	}
+	if _, ok := tx3.Commit().(*ConflictError); !ok {
+		t.Fatal("read should of conflicted")
+	}
+	if err = tx4.Commit(); err != nil {
+		t.Fatal("lookup outside the written keys should not conflict", err)
+	}
+
+	tx, _ := db.BeginTX("main")
+	value, err := tx.Get([]byte("mykey"))
+	if err != nil || string(value) != "myvalue1" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Put([]byte("mykey"), []byte("myvalue3"))
+	if err = tx.Commit(); err != nil {
+		t.Fatal("transaction that began after the commit should not conflict", err)
+	}
+	if n := len(db.tables["main"].commits); n != 0 {
+		t.Fatal("commits should be discarded when there are no open transactions", n)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestConflictFailedCommit(t *testing.T) {
+	path := "test/conflictdb"
+	Remove(path)
+
+	db, err := OpenWithOptions(path, Options{CreateIfNeeded: true, Isolation: Serializable})
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	tx1, _ := db.BeginTX("main")
+	tx2, _ := db.BeginTX("main")
+	tx1.Put([]byte("mykey"), []byte("myvalue1"))
+	tx2.Put([]byte("mykey"), []byte("myvalue2"))
+
+	// the log cannot be written, so the commit fails
+	db.wal.Lock()
+	file := db.wal.file
+	closed, err := os.Open(file.Name())
+	if err != nil {
+		t.Fatal("unable to open log", err)
+	}
+	closed.Close()
+	db.wal.file = closed
+	db.wal.Unlock()
+
+	if err = tx1.Commit(); err == nil {
+		t.Fatal("the commit should fail")
+	}
+
+	db.wal.Lock()
+	db.wal.file = file
+	db.wal.Unlock()
+
+	// the failed commit was never made, so it cannot conflict
+	if err = tx2.Commit(); err != nil {
+		t.Fatal("transaction should not conflict with a failed commit", err)
+	}
+	tx, _ := db.BeginTX("main")
+	if value, err := tx.Get([]byte("mykey")); err != nil || string(value) != "myvalue2" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	tx.Rollback()
+
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestMultiTransaction(t *testing.T) {
+	path := "test/multidb"
+	Remove(path)
+
+	db, err := Open(path, true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	mtx, err := db.BeginMultiTX("orders", "positions", "orders")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	if _, err = mtx.Table("other"); err != TableNotInTransaction {
+		t.Fatal("table should not be part of the transaction", err)
+	}
+	orders, _ := mtx.Table("orders")
+	positions, _ := mtx.Table("positions")
+	orders.Put([]byte("order1"), []byte("buy 100"))
+	positions.Put([]byte("position1"), []byte("100"))
+	if err = orders.Commit(); err != PartOfMultiTransaction {
+		t.Fatal("table transaction should not commit on its own", err)
+	}
+	if err = mtx.CommitSync(); err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	if _, err = orders.Get([]byte("order1")); err != TransactionClosed {
+		t.Fatal("transaction should be closed", err)
+	}
+
+	// a multi table commit that was logged but never written to disk
+	m1 := newMemorySegment()
+	m1.Put([]byte("order2"), []byte("sell 50"))
+	m2 := newMemorySegment()
+	m2.Put([]byte("position1"), []byte("50"))
+	records := []walRecord{{id: db.nextSegmentID(), table: "orders", seg: m1}, {id: db.nextSegmentID(), table: "positions", seg: m2}}
+	if err = db.wal.logSegments(records, true); err != nil {
+		t.Fatal("unable to log segments", err)
+	}
+
+	// simulate a crash
+	db.Lock()
+	db.closing = true
+	db.Unlock()
+	db.wg.Wait()
+	db.wal.close()
+	db.lockfile.Unlock()
+
+	db, err = Open(path, false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if len(db.RecoveryReport()) != 2 {
+		t.Fatal("both segments should be recovered", db.RecoveryReport())
+	}
+	mtx, err = db.BeginMultiTX("orders", "positions")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	orders, _ = mtx.Table("orders")
+	positions, _ = mtx.Table("positions")
+	for _, kv := range []struct {
+		tx         *Transaction
+		key, value string
+	}{{orders, "order1", "buy 100"}, {orders, "order2", "sell 50"}, {positions, "position1", "50"}} {
+		value, err := kv.tx.Get([]byte(kv.key))
+		if err != nil || string(value) != kv.value {
+			t.Fatal("incorrect value for", kv.key, string(value), err)
+		}
+	}
+	if err = mtx.Rollback(); err != nil {
+		t.Fatal("unable to rollback", err)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
@@ -1,22 +1,25 @@
 package keydb
 
 import (
-	"bytes"
 	"fmt"
 )
 
 // Tree is an auto balancing CVL tree, based on code from 'applied go', but modified for []byte key and values,
-// and range searching
+// and range searching. the keys are ordered by cmp, or bytewise if it is nil
 type Tree struct {
 	root *node
+	cmp  Comparator
 }
 
 type node struct {
 	key   []byte
 	data  []byte
-	left  *node
-	right *node
-	h     int
+	merge bool // data is a list of merge operands
+	// the time the key expires in unix nanoseconds, 0 if it does not expire
+	expires int64
+	left    *node
+	right   *node
+	h       int
 }
 
 func (n *node) height() int {
@@ -30,22 +33,25 @@ func (n *node) balance() int {
 	return n.right.height() - n.left.height()
 }
 
-func (n *node) insert(key, data []byte) *node {
+func (n *node) insert(key, data []byte, merge bool, expires int64, cmp Comparator) *node {
 
 	if n == nil {
-		return &node{key: key, data: data, h: 1}
+		return &node{key: key, data: data, merge: merge, expires: expires, h: 1}
 	}
 
-	if bytes.Equal(key, n.key) {
+	c := compareKeys(cmp, key, n.key)
+	if c == 0 {
 		// node already exists nothing changes
 		n.data = data
+		n.merge = merge
+		n.expires = expires
 		return n
 	}
 
-	if less(key, n.key) {
-		n.left = n.left.insert(key, data)
+	if c < 0 {
+		n.left = n.left.insert(key, data, merge, expires, cmp)
 	} else {
-		n.right = n.right.insert(key, data)
+		n.right = n.right.insert(key, data, merge, expires, cmp)
 	}
 
 	n.h = max(n.left.height(), n.right.height()) + 1
@@ -95,60 +101,92 @@ func (n *node) rotateRight() *node {
 }
 
 func (n *node) Find(key []byte) ([]byte, bool) {
+	found := n.find(key, nil)
+	if found == nil {
+		return nil, false
+	}
+	return found.data, true
+}
+
+func (n *node) find(key []byte, cmp Comparator) *node {
 
 	if n == nil {
-		return nil, false
+		return nil
 	}
 
-	if equal(key, n.key) {
-		return n.data, true
+	c := compareKeys(cmp, key, n.key)
+	if c == 0 {
+		return n
 	}
 
-	if less(key, n.key) {
-		return n.left.Find(key)
+	if c < 0 {
+		return n.left.find(key, cmp)
 	} else {
-		return n.right.Find(key)
+		return n.right.find(key, cmp)
 	}
 }
 
 // Remove does not actual remove the node, but instead stores a 'nil' Value. This is essential to allow the
 // memory index to track removals for other segments
 func (n *node) Remove(key []byte) ([]byte, bool) {
+	return n.remove(key, nil)
+}
+
+func (n *node) remove(key []byte, cmp Comparator) ([]byte, bool) {
 
 	if n == nil {
 		return nil, false
 	}
 
-	if bytes.Equal(key, n.key) {
+	c := compareKeys(cmp, key, n.key)
+	if c == 0 {
 		prev := n.data
 		n.data = nil
+		n.merge = false
+		n.expires = 0
 		return prev, true
 	}
 
-	if less(key, n.key) {
-		return n.left.Remove(key)
+	if c < 0 {
+		return n.left.remove(key, cmp)
 	} else {
-		return n.right.Remove(key)
+		return n.right.remove(key, cmp)
 	}
 }
 
 // Insert a key value pair into the Tree
 func (t *Tree) Insert(key, data []byte) {
-	t.root = t.root.insert(key, data)
+	t.root = t.root.insert(key, data, false, 0, t.cmp)
+}
+
+// inserts a list of merge operands, see appendOperand
+func (t *Tree) insertOperands(key, operands []byte) {
+	t.root = t.root.insert(key, operands, true, 0, t.cmp)
+}
+
+// inserts a value that expires at the time in unix nanoseconds
+func (t *Tree) insertExpiring(key, data []byte, expires int64) {
+	t.root = t.root.insert(key, data, false, expires, t.cmp)
 }
 
 // Find the value for a given key, ok is true if the key was found
 func (t *Tree) Find(key []byte) (value []byte, ok bool) {
-	if t.root == nil {
+	n := t.find(key)
+	if n == nil {
 		return nil, false
 	}
-	return t.root.Find(key)
+	return n.data, true
+}
+
+// returns the node for the key, or nil if the key was not found
+func (t *Tree) find(key []byte) *node {
+	return t.root.find(key, t.cmp)
 }
 
 // Remove the value for a key, returning it. ok is true if the node existed and was found. If the key was not
 // found a 'nil' value is inserted into the tree
 func (t *Tree) Remove(key []byte) (value []byte, ok bool) {
-	old, ok := t.root.Remove(key)
+	old, ok := t.root.remove(key, t.cmp)
 	if !ok {
 		t.Insert(key, nil)
 		return nil, false
@@ -159,13 +197,19 @@ func (t *Tree) Remove(key []byte) (value []byte, ok bool) {
 
 // TreeEntry is node returned by FindNodes
 type TreeEntry struct {
-	Key   []byte
-	Value []byte
+	Key     []byte
+	Value   []byte
+	merge   bool  // Value is a list of merge operands
+	expires int64 // the expiry of the key, 0 if it does not expire
 }
 
 // FindNodes calls function fn on nodes with key between lower and upper inclusive
 // 找到在[lower,upper]区间内的节点，对其执行fn函数
 func FindNodes(node *node, lower []byte, upper []byte, fn func(*node)) {
+	findRange(node, Range{Lower: lower, Upper: upper}, nil, fn)
+}
+
+func findRange(node *node, r Range, cmp Comparator, fn func(*node)) {
 	if node == nil {
 		return
 	}
@@ -173,24 +217,29 @@ func FindNodes(node *node, lower []byte, upper []byte, fn func(*node)) {
 	/* Since the desired o/p is sorted, recurse for left subtree first
 	   If node.key is greater than lower, then only we can get o/p keys
 	   in left subtree */
-	if lower == nil || less(lower, node.key) {
-		FindNodes(node.left, lower, upper, fn)
+	if r.Lower == nil || lessKeys(cmp, r.Lower, node.key) {
+		findRange(node.left, r, cmp, fn)
 	}
 
-	if isNodeInRange(node, lower, upper) {
+	if r.contains(cmp, node.key) {
 		fn(node)
 	}
 
 	/* If node.key is smaller than upper, then only we can get o/p keys
 	in right subtree */
-	if upper == nil || less(node.key, upper) {
-		FindNodes(node.right, lower, upper, fn)
+	if r.Upper == nil || lessKeys(cmp, node.key, r.Upper) {
+		findRange(node.right, r, cmp, fn)
 	}
 }
 
 // FindNodes returns a slice of nodes with the keys in range lower and upper inclusive
 // 找到[lower,upper]区间内的所有节点内，构造成TreeEntry数组返回
 func (t *Tree) FindNodes(lower []byte, upper []byte) []TreeEntry {
+	return t.FindRange(Range{Lower: lower, Upper: upper})
+}
+
+// FindRange returns a slice of nodes with the keys in the range
+func (t *Tree) FindRange(r Range) []TreeEntry {
 	if t.root == nil {
 		return nil
 	}
@@ -198,23 +247,12 @@ func (t *Tree) FindNodes(lower []byte, upper []byte) []TreeEntry {
 	results := make([]TreeEntry, 0)
 
 	nodeInRange := func(n *node) {
-		results = append(results, TreeEntry{n.key, n.data})
+		results = append(results, TreeEntry{Key: n.key, Value: n.data, merge: n.merge, expires: n.expires})
 	}
-	FindNodes(t.root, lower, upper, nodeInRange)
+	findRange(t.root, r, t.cmp, nodeInRange)
 	return results
 }
 
-func isNodeInRange(n *node, lower []byte, upper []byte) bool {
-	if n == nil {
-		return false
-	}
-	if equal(n.key, lower) || equal(n.key, upper) {
-		return true
-	} else {
-		return (upper == nil || less(n.key, upper)) && (lower == nil || less(lower, n.key))
-	}
-}
-
 type queue struct {
 	values []*node
 }
@@ -0,0 +1,16 @@
+package keydb
+
+import "time"
+
+// a value put with PutWithTTL records the time it expires. an expired value reads as a removed key, so it still hides
+// the value of the key in older segments, and the merger writes it as removed, which drops the value
+
+// returns the current time in unix nanoseconds, which the expiry of a value is compared with
+func nowNanos() int64 {
+	return time.Now().UnixNano()
+}
+
+// returns true if a value with the expiry has expired at now, an expiry of 0 never expires
+func expired(expires int64, now int64) bool {
+	return expires != 0 && expires <= now
+}
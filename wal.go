@@ -0,0 +1,498 @@
+package keydb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// the write-ahead log records every committed memory segment before Commit returns, so that segments
+// which never made it to disk can be rebuilt when the database is opened. the log is a sequence of records
+//
+// length uint32 (length of the payload)
+// crc uint32 (crc32 of the payload)
+// payload []byte
+//
+// a segment payload is
+// type uint8 (walSegment)
+// id uint64
+// tablelen uint16
+// table []byte
+// count uint32
+// and count entries of
+// keylen uint16
+// key []byte
+// valuelen uint32 (removedKeyLen if the key is removed)
+// value []byte
+// and if the segment has range tombstones, merge operands or expiring values
+// rangecount uint32
+// and rangecount ranges (see appendRange)
+// and if the segment has merge operands or expiring values
+// opcount uint32
+// and opcount entries of
+// keylen uint16
+// key []byte
+// operandslen uint32
+// operands []byte (see appendOperand)
+// and if the segment has expiring values
+// expcount uint32
+// and expcount entries of
+// keylen uint16
+// key []byte
+// expires int64 (unix nanoseconds)
+// valuelen uint32
+// value []byte
+//
+// a done payload marks a segment as written to disk
+// type uint8 (walDone)
+// id uint64
+//
+// a multi payload holds the segments of a multi table transaction, which are recovered all or nothing
+// type uint8 (walMulti)
+// count uint32
+// and count entries of
+// length uint32
+// segment payload []byte
+//
+// once every logged segment has been written the log is truncated. a partially written record at the
+// end of the log is ignored, since its Commit never returned
+const walFilename = "keydb.wal"
+
+const (
+	walSegment uint8 = 1
+	walDone    uint8 = 2
+	walMulti   uint8 = 3
+)
+
+var errCorruptLog = errors.New("corrupt write-ahead log record")
+
+type writeAheadLog struct {
+	sync.Mutex
+	file    *os.File
+	pending map[uint64]bool // logged segments not yet written to disk
+}
+
+// syncs the log when a segment is logged, tests replace it to observe the syncs
+var syncLog = func(f *os.File) error {
+	return f.Sync()
+}
+
+// a segment recovered from the log
+type walRecord struct {
+	id    uint64
+	table string
+	seg   segment
+}
+
+// opens the log in the database directory, returning the logged segments that were not written to disk, in log order.
+// the keys of each segment are ordered by the comparator of its table
+func openWAL(dbpath string, comparator func(table string) Comparator) (*writeAheadLog, []walRecord, error) {
+	f, err := os.OpenFile(filepath.Join(dbpath, walFilename), os.O_CREATE|os.O_RDWR|os.O_APPEND, os.ModePerm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, err := readWAL(f, comparator)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return &writeAheadLog{file: f, pending: make(map[uint64]bool)}, records, nil
+}
+
+func readWAL(r io.Reader, comparator func(table string) Comparator) ([]walRecord, error) {
+	br := bufio.NewReader(r)
+
+	var records []walRecord
+	done := make(map[uint64]bool)
+
+	for {
+		payload, err := readLogRecord(br)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorruptLog {
+			// a torn write at the end of the log
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch payload[0] {
+		case walSegment:
+			rec, err := decodeWALSegment(payload[1:], comparator)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, rec)
+		case walMulti:
+			recs, err := decodeWALMulti(payload[1:], comparator)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, recs...)
+		case walDone:
+			if len(payload) < 9 {
+				return nil, errCorruptLog
+			}
+			done[binary.LittleEndian.Uint64(payload[1:])] = true
+		default:
+			return nil, errCorruptLog
+		}
+	}
+
+	pending := make([]walRecord, 0)
+	for _, rec := range records {
+		if !done[rec.id] {
+			pending = append(pending, rec)
+		}
+	}
+	return pending, nil
+}
+
+// reads the next length/crc framed record, returning its payload
+func readLogRecord(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[:])
+	crc := binary.LittleEndian.Uint32(header[4:])
+	if length == 0 {
+		return nil, errCorruptLog
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != crc {
+		return nil, errCorruptLog
+	}
+	return payload, nil
+}
+
+// frames the payload as a length/crc record
+func encodeLogRecord(payload []byte) []byte {
+	record := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[8:], payload)
+	return record
+}
+
+func encodeWALSegment(id uint64, table string, seg segment) ([]byte, int, error) {
+	itr, err := seg.Lookup(nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	payload := make([]byte, 1+8+2+len(table)+4)
+	payload[0] = walSegment
+	binary.LittleEndian.PutUint64(payload[1:], id)
+	binary.LittleEndian.PutUint16(payload[9:], uint16(len(table)))
+	copy(payload[11:], table)
+
+	var count int
+	var buf [8]byte
+	// the keys with merge operands or an expiry are logged after the range tombstones, so older logs can still be read
+	var operands, expiring []byte
+	var opcount, expcount int
+	for {
+		key, value, err := itr.Next()
+		if err == EndOfIterator {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if value != nil && itr.operands() {
+			binary.LittleEndian.PutUint16(buf[:], uint16(len(key)))
+			operands = append(operands, buf[:2]...)
+			operands = append(operands, key...)
+			binary.LittleEndian.PutUint32(buf[:], uint32(len(value)))
+			operands = append(operands, buf[:4]...)
+			operands = append(operands, value...)
+			opcount++
+			continue
+		}
+		if value != nil && itr.expiry() != 0 {
+			binary.LittleEndian.PutUint16(buf[:], uint16(len(key)))
+			expiring = append(expiring, buf[:2]...)
+			expiring = append(expiring, key...)
+			binary.LittleEndian.PutUint64(buf[:], uint64(itr.expiry()))
+			expiring = append(expiring, buf[:8]...)
+			binary.LittleEndian.PutUint32(buf[:], uint32(len(value)))
+			expiring = append(expiring, buf[:4]...)
+			expiring = append(expiring, value...)
+			expcount++
+			continue
+		}
+		binary.LittleEndian.PutUint16(buf[:], uint16(len(key)))
+		payload = append(payload, buf[:2]...)
+		payload = append(payload, key...)
+		if value == nil {
+			binary.LittleEndian.PutUint32(buf[:], removedKeyLen)
+		} else {
+			binary.LittleEndian.PutUint32(buf[:], uint32(len(value)))
+		}
+		payload = append(payload, buf[:4]...)
+		payload = append(payload, value...)
+		count++
+	}
+	binary.LittleEndian.PutUint32(payload[11+len(table):], uint32(count))
+
+	// the range tombstones follow the keys, a segment without them may omit the count
+	ranges := seg.RangeTombstones()
+	if len(ranges) > 0 || opcount > 0 || expcount > 0 {
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(ranges)))
+		payload = append(payload, buf[:4]...)
+		for _, r := range ranges {
+			payload = appendRange(payload, r)
+		}
+	}
+	if opcount > 0 || expcount > 0 {
+		binary.LittleEndian.PutUint32(buf[:], uint32(opcount))
+		payload = append(payload, buf[:4]...)
+		payload = append(payload, operands...)
+	}
+	if expcount > 0 {
+		binary.LittleEndian.PutUint32(buf[:], uint32(expcount))
+		payload = append(payload, buf[:4]...)
+		payload = append(payload, expiring...)
+	}
+
+	return payload, count + len(ranges) + opcount + expcount, nil
+}
+
+func decodeWALSegment(payload []byte, comparator func(table string) Comparator) (walRecord, error) {
+	var rec walRecord
+
+	if len(payload) < 10 {
+		return rec, errCorruptLog
+	}
+	rec.id = binary.LittleEndian.Uint64(payload)
+	tablelen := int(binary.LittleEndian.Uint16(payload[8:]))
+	payload = payload[10:]
+	if len(payload) < tablelen+4 {
+		return rec, errCorruptLog
+	}
+	rec.table = string(payload[:tablelen])
+	count := binary.LittleEndian.Uint32(payload[tablelen:])
+	payload = payload[tablelen+4:]
+
+	ms := &memorySegment{tree: &Tree{cmp: comparator(rec.table)}}
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 2 {
+			return rec, errCorruptLog
+		}
+		keylen := int(binary.LittleEndian.Uint16(payload))
+		payload = payload[2:]
+		if len(payload) < keylen+4 {
+			return rec, errCorruptLog
+		}
+		key := payload[:keylen]
+		valuelen := binary.LittleEndian.Uint32(payload[keylen:])
+		payload = payload[keylen+4:]
+
+		var value []byte
+		if valuelen != removedKeyLen {
+			if uint32(len(payload)) < valuelen {
+				return rec, errCorruptLog
+			}
+			value = payload[:valuelen]
+			payload = payload[valuelen:]
+		}
+		ms.Put(key, value)
+	}
+	if len(payload) >= 4 {
+		count := binary.LittleEndian.Uint32(payload)
+		payload = payload[4:]
+		for i := uint32(0); i < count; i++ {
+			var r Range
+			var ok bool
+			if r, payload, ok = decodeRange(payload); !ok {
+				return rec, errCorruptLog
+			}
+			// the keys of the segment are newer than its tombstones, so the tombstones are not applied to them
+			ms.ranges = append(ms.ranges, r)
+		}
+	}
+	if len(payload) >= 4 {
+		count := binary.LittleEndian.Uint32(payload)
+		payload = payload[4:]
+		for i := uint32(0); i < count; i++ {
+			if len(payload) < 2 {
+				return rec, errCorruptLog
+			}
+			keylen := int(binary.LittleEndian.Uint16(payload))
+			payload = payload[2:]
+			if len(payload) < keylen+4 {
+				return rec, errCorruptLog
+			}
+			key := payload[:keylen]
+			operandslen := binary.LittleEndian.Uint32(payload[keylen:])
+			payload = payload[keylen+4:]
+			if uint32(len(payload)) < operandslen {
+				return rec, errCorruptLog
+			}
+			ms.PutOperands(key, payload[:operandslen])
+			payload = payload[operandslen:]
+		}
+	}
+	if len(payload) >= 4 {
+		count := binary.LittleEndian.Uint32(payload)
+		payload = payload[4:]
+		for i := uint32(0); i < count; i++ {
+			if len(payload) < 2 {
+				return rec, errCorruptLog
+			}
+			keylen := int(binary.LittleEndian.Uint16(payload))
+			payload = payload[2:]
+			if len(payload) < keylen+8+4 {
+				return rec, errCorruptLog
+			}
+			key := payload[:keylen]
+			expires := int64(binary.LittleEndian.Uint64(payload[keylen:]))
+			valuelen := binary.LittleEndian.Uint32(payload[keylen+8:])
+			payload = payload[keylen+8+4:]
+			if uint32(len(payload)) < valuelen {
+				return rec, errCorruptLog
+			}
+			ms.PutExpiring(key, payload[:valuelen], expires)
+			payload = payload[valuelen:]
+		}
+	}
+	rec.seg = ms
+	return rec, nil
+}
+
+func decodeWALMulti(payload []byte, comparator func(table string) Comparator) ([]walRecord, error) {
+	if len(payload) < 4 {
+		return nil, errCorruptLog
+	}
+	count := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+
+	var records []walRecord
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 4 {
+			return nil, errCorruptLog
+		}
+		length := binary.LittleEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < length || length < 1 || payload[0] != walSegment {
+			return nil, errCorruptLog
+		}
+		rec, err := decodeWALSegment(payload[1:length], comparator)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+		payload = payload[length:]
+	}
+	return records, nil
+}
+
+// records the committed memory segments of a multi table transaction as a single record, syncing the log if sync
+// is true. empty segments are not logged
+func (wal *writeAheadLog) logSegments(records []walRecord, sync bool) error {
+	payload := make([]byte, 5)
+	payload[0] = walMulti
+
+	var logged []uint64
+	var buf [4]byte
+	for _, rec := range records {
+		segment, n, err := encodeWALSegment(rec.id, rec.table, rec.seg)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		binary.LittleEndian.PutUint32(buf[:], uint32(len(segment)))
+		payload = append(payload, buf[:]...)
+		payload = append(payload, segment...)
+		logged = append(logged, rec.id)
+	}
+	if len(logged) == 0 {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(payload[1:], uint32(len(logged)))
+
+	wal.Lock()
+	defer wal.Unlock()
+
+	if _, err := wal.file.Write(encodeLogRecord(payload)); err != nil {
+		return err
+	}
+	if sync {
+		if err := syncLog(wal.file); err != nil {
+			return err
+		}
+	}
+	for _, id := range logged {
+		wal.pending[id] = true
+	}
+	return nil
+}
+
+// records a committed memory segment, syncing the log if sync is true. empty segments are not logged
+func (wal *writeAheadLog) logSegment(id uint64, table string, seg segment, sync bool) error {
+	payload, count, err := encodeWALSegment(id, table, seg)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	wal.Lock()
+	defer wal.Unlock()
+
+	if _, err := wal.file.Write(encodeLogRecord(payload)); err != nil {
+		return err
+	}
+	if sync {
+		if err := syncLog(wal.file); err != nil {
+			return err
+		}
+	}
+	wal.pending[id] = true
+	return nil
+}
+
+// marks a logged segment as written to disk, truncating the log if no logged segments remain
+func (wal *writeAheadLog) segmentWritten(id uint64) error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	if !wal.pending[id] {
+		return nil
+	}
+	delete(wal.pending, id)
+
+	if len(wal.pending) == 0 {
+		return wal.file.Truncate(0)
+	}
+
+	payload := make([]byte, 9)
+	payload[0] = walDone
+	binary.LittleEndian.PutUint64(payload[1:], id)
+	_, err := wal.file.Write(encodeLogRecord(payload))
+	return err
+}
+
+// discards the log, called once the recovered segments have been written
+func (wal *writeAheadLog) truncate() error {
+	wal.Lock()
+	defer wal.Unlock()
+
+	return wal.file.Truncate(0)
+}
+
+func (wal *writeAheadLog) close() error {
+	return wal.file.Close()
+}
@@ -0,0 +1,273 @@
+package keydb
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWALRecovery(t *testing.T) {
+	Remove("test/waldb")
+
+	db, err := Open("test/waldb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	ms := newMemorySegment()
+	ms.Put([]byte("mykey"), []byte("myvalue"))
+	ms.Put([]byte("mykey2"), []byte("myvalue2"))
+	ms.Remove([]byte("mykey3"))
+	ms.PutOperands([]byte("mykey5"), appendOperand(nil, []byte("myvalue5")))
+	ms.PutExpiring([]byte("mykey6"), []byte("myvalue6"), nowNanos()+int64(time.Hour))
+	ms.PutExpiring([]byte("mykey7"), []byte("myvalue7"), nowNanos()+int64(100*time.Millisecond))
+
+	err = db.wal.logSegment(db.nextSegmentID(), "main", ms, true)
+	if err != nil {
+		t.Fatal("unable to log segment", err)
+	}
+
+	// a segment with only a range tombstone
+	ms = newMemorySegment()
+	ms.RemoveRange(Range{Lower: []byte("mykey2"), Upper: []byte("mykey2")})
+
+	err = db.wal.logSegment(db.nextSegmentID(), "main", ms, true)
+	if err != nil {
+		t.Fatal("unable to log segment", err)
+	}
+
+	// simulate a crash, the segment was logged but never written to disk
+	db.Lock()
+	db.closing = true
+	db.Unlock()
+	db.wg.Wait()
+	db.wal.close()
+	db.lockfile.Unlock()
+	time.Sleep(200 * time.Millisecond)
+
+	db, err = OpenWithOptions("test/waldb", Options{MergeOperator: appendOperator{}})
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	value, err := tx.Get([]byte("mykey"))
+	if err != nil {
+		t.Fatal("unable to get recovered key", err)
+	}
+	if string(value) != "myvalue" {
+		t.Fatal("incorrect value", string(value))
+	}
+	_, err = tx.Get([]byte("mykey3"))
+	if err != KeyNotFound {
+		t.Fatal("removed key should not be found", err)
+	}
+	_, err = tx.Get([]byte("mykey2"))
+	if err != KeyNotFound {
+		t.Fatal("key in removed range should not be found", err)
+	}
+	value, err = tx.Get([]byte("mykey5"))
+	if err != nil || string(value) != "myvalue5" {
+		t.Fatal("incorrect value for recovered merge operands", string(value), err)
+	}
+	value, err = tx.Get([]byte("mykey6"))
+	if err != nil || string(value) != "myvalue6" {
+		t.Fatal("incorrect value for recovered expiring key", string(value), err)
+	}
+	_, err = tx.Get([]byte("mykey7"))
+	if err != KeyNotFound {
+		t.Fatal("expired key should not be found", err)
+	}
+	err = tx.Put([]byte("mykey4"), []byte("myvalue4"))
+	if err != nil {
+		t.Fatal("unable to put key/Value", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	fi, err := os.Stat("test/waldb/" + walFilename)
+	if err != nil {
+		t.Fatal("missing write-ahead log", err)
+	}
+	if fi.Size() != 0 {
+		t.Fatal("write-ahead log should be empty after close, size is", fi.Size())
+	}
+}
+
+func TestWALRecoveryWrittenSegment(t *testing.T) {
+	Remove("test/waldb")
+
+	db, err := Open("test/waldb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 2; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		if err = tx.CommitSync(); err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	// the segment is written and added to the manifest as writeSegmentToDisk does, but the process crashes before
+	// the log records that it was written
+	ms := newMemorySegment()
+	ms.Put([]byte("mykey2"), []byte("myvalue2"))
+	id := db.nextSegmentID()
+	if err = db.wal.logSegment(id, "main", ms, true); err != nil {
+		t.Fatal("unable to log segment", err)
+	}
+	itr, _ := ms.Lookup(nil, nil)
+	keyFilename, dataFilename := segmentFilenames(db.path, "main", id)
+	ds, err := writeAndLoadSegment(keyFilename, dataFilename, itr, nil, db.segmentOptions("main"))
+	if err != nil {
+		t.Fatal("unable to write segment", err)
+	}
+	err = db.manifest.apply([]manifestChange{{op: addSegment, table: "main", info: newSegmentInfo(ds.(*diskSegment))}}, true)
+	ds.Close()
+	if err != nil {
+		t.Fatal("unable to apply manifest", err)
+	}
+
+	db.Lock()
+	db.closing = true
+	db.Unlock()
+	db.wg.Wait()
+	db.wal.close()
+	db.manifest.close()
+	db.lockfile.Unlock()
+	time.Sleep(200 * time.Millisecond)
+
+	db, err = Open("test/waldb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if segments := db.manifest.segments("main"); len(segments) != 3 {
+		t.Fatal("the segment should only be in the manifest once", segments)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 3; i++ {
+		if value, err := tx.Get([]byte(fmt.Sprint("mykey", i))); err != nil || string(value) != fmt.Sprint("myvalue", i) {
+			t.Fatal("incorrect value", string(value), err)
+		}
+	}
+	tx.Rollback()
+
+	// merging the segments removes the files of each once
+	if err = db.CloseWithMerge(1); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = Open("test/waldb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if segments := db.manifest.segments("main"); len(segments) != 1 {
+		t.Fatal("the segments should be merged", segments)
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestSyncOnCommit(t *testing.T) {
+	Remove("test/mydb")
+
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	db.SetDurability(SyncOnCommit)
+
+	// counts the syncs of the log
+	var count uint64
+	defer func(sync func(*os.File) error) {
+		syncLog = sync
+	}(syncLog)
+	syncLog = func(f *os.File) error {
+		atomic.AddUint64(&count, 1)
+		return f.Sync()
+	}
+	syncs := func() uint64 {
+		return atomic.LoadUint64(&count)
+	}
+
+	commit := func(i int) {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		err = tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		if err != nil {
+			t.Fatal("unable to put key/Value", err)
+		}
+		if i%2 == 0 {
+			err = tx.Commit()
+		} else {
+			err = tx.CommitSync()
+		}
+		if err != nil {
+			t.Fatal("unable to commit transaction", err)
+		}
+	}
+
+	// every commit syncs the log before it returns
+	for i := 0; i < 10; i++ {
+		commit(i)
+		if n := syncs(); n != uint64(i+1) {
+			t.Fatal("the commit did not sync the log", i, n)
+		}
+	}
+
+	db.SetDurability(SyncNone)
+	commit(10)
+	if n := syncs(); n != 10 {
+		t.Fatal("the log should not be synced with SyncNone", n)
+	}
+
+	// simulate a crash, the database is not closed
+	db.Lock()
+	db.closing = true
+	db.Unlock()
+	db.wg.Wait()
+	db.wal.close()
+	db.manifest.close()
+	db.lockfile.Unlock()
+	time.Sleep(200 * time.Millisecond)
+
+	db, err = Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	// the log protects every commit against a process crash, whatever the durability
+	for i := 0; i <= 10; i++ {
+		value, err := tx.Get([]byte(fmt.Sprint("mykey", i)))
+		if err != nil || string(value) != fmt.Sprint("myvalue", i) {
+			t.Fatal("incorrect value after reopen", string(value), err)
+		}
+	}
+	tx.Commit()
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}